@@ -21,17 +21,31 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
 
 	"github.com/rakyll/drivefuse/logger"
+	"github.com/rakyll/drivefuse/metrics"
 )
 
+var cacheReads = metrics.NewCounter(
+	"drivefuse_cache_reads_total",
+	"Reads from the blob cache, result is either hit or miss.",
+	"account", "result")
+
+// Checksum of the blobs holding local modifications that are not
+// uploaded yet, they are kept regardless of the remote checksum.
+const LocalChecksum = "local"
+
 type Manager struct {
 	blobPath string
+
+	// name of the account, used to label metrics
+	account string
 }
 
-func New(blobPath string) *Manager {
-	return &Manager{blobPath: blobPath}
+func New(blobPath string, account string) *Manager {
+	return &Manager{blobPath: blobPath, account: account}
 }
 
 func (f *Manager) Save(id int64, checksum string, rc io.ReadCloser) error {
@@ -65,9 +79,11 @@ func (f *Manager) Read(id int64, checksum string, seek int64, l int) (blob []byt
 	var file *os.File
 	file, err = os.Open(f.getBlobPath(id, checksum))
 	if err != nil {
+		cacheReads.Inc(f.account, "miss")
 		return
 	}
 	defer file.Close()
+	cacheReads.Inc(f.account, "hit")
 
 	blob = make([]byte, l)
 	file.Seek(seek, 0)
@@ -76,6 +92,95 @@ func (f *Manager) Read(id int64, checksum string, seek int64, l int) (blob []byt
 	return blob, int64(s), err
 }
 
+// Opens the blob for reading, e.g. to upload its contents.
+func (f *Manager) Open(id int64, checksum string) (*os.File, error) {
+	return os.Open(f.getBlobPath(id, checksum))
+}
+
+// Reads the local modifications of a blob if there are any, the
+// blob with the checksum otherwise.
+func (f *Manager) ReadModified(id int64, checksum string, seek int64, l int) ([]byte, int64, error) {
+	if _, err := os.Stat(f.getBlobPath(id, LocalChecksum)); err == nil {
+		checksum = LocalChecksum
+	}
+	return f.Read(id, checksum, seek, l)
+}
+
+// Prepares the local modifications of a blob to be written, it's
+// a copy of the blob with the checksum unless it's truncated.
+func (f *Manager) Modify(id int64, checksum string, truncate bool) (err error) {
+	if _, err = os.Stat(f.getBlobPath(id, LocalChecksum)); err == nil && !truncate {
+		return
+	}
+	if err = os.MkdirAll(f.getBlobDir(id), 0750); err != nil {
+		return
+	}
+	var src *os.File
+	if !truncate {
+		if src, err = os.Open(f.getBlobPath(id, checksum)); err != nil {
+			return
+		}
+		defer src.Close()
+	}
+	var dst *os.File
+	if dst, err = os.Create(f.getBlobPath(id, LocalChecksum)); err != nil {
+		return
+	}
+	defer dst.Close()
+	if src != nil {
+		_, err = io.Copy(dst, src)
+	}
+	return
+}
+
+// Writes data to an existing blob at offset, gets the size
+// of the blob once written.
+func (f *Manager) WriteAt(id int64, checksum string, data []byte, offset int64) (size int64, err error) {
+	var file *os.File
+	if file, err = os.OpenFile(f.getBlobPath(id, checksum), os.O_WRONLY, 0); err != nil {
+		return
+	}
+	defer file.Close()
+	if _, err = file.WriteAt(data, offset); err != nil {
+		return
+	}
+	var info os.FileInfo
+	if info, err = file.Stat(); err != nil {
+		return
+	}
+	return info.Size(), nil
+}
+
+// Renames a blob once the checksum of its contents is known, the
+// other blobs of the file are removed.
+func (f *Manager) Rename(id int64, checksum string, newChecksum string) error {
+	if checksum == newChecksum {
+		return nil
+	}
+	if err := os.Rename(f.getBlobPath(id, checksum), f.getBlobPath(id, newChecksum)); err != nil {
+		return err
+	}
+	return f.cleanup(id, newChecksum)
+}
+
+// Usage gets the number and total size of the cached blobs.
+func (f *Manager) Usage() (count int64, size int64, err error) {
+	err = filepath.Walk(f.blobPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			count++
+			size += info.Size()
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return
+}
+
 func (f *Manager) Delete(id int64) error {
 	// TODO(burcud): rm directory if not required anymore
 	return f.cleanup(id, "*")
@@ -0,0 +1,118 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/rakyll/drivefuse/config"
+	"github.com/rakyll/drivefuse/daemon"
+)
+
+func newAccountsCommand() *command {
+	c := newCommand("accounts", "list | add | remove [-purge] <account>",
+		"Lists, adds or removes the configured accounts.\nChanges are picked up once the daemon is restarted.")
+	c.run = func(cfg *config.Config, args []string) error {
+		if len(args) == 0 {
+			c.usage()
+			return errors.New("missing subcommand")
+		}
+		switch args[0] {
+		case "list":
+			return listAccounts(cfg)
+		case "add":
+			return addAccount(cfg)
+		case "remove":
+			return removeAccount(cfg, args[1:])
+		}
+		c.usage()
+		return fmt.Errorf("unknown subcommand %q", args[0])
+	}
+	return c
+}
+
+func listAccounts(cfg *config.Config) error {
+	if err := cfg.Load(); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tMOUNT POINT\tREMOTE FOLDER")
+	for _, a := range cfg.Accounts {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", a.Name, a.LocalPath, a.RemoteId)
+	}
+	return w.Flush()
+}
+
+// Runs the wizard for a new account, replaces the existing
+// account with the same name.
+func addAccount(cfg *config.Config) error {
+	fmt.Println(messageAddAccount)
+	loadExisting(cfg)
+	if err := readConfig(cfg); err != nil {
+		return err
+	}
+	if err := cfg.Save(); err != nil {
+		return err
+	}
+	fmt.Println("\nConfig written to", cfg.ConfigPath())
+	return nil
+}
+
+func removeAccount(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("accounts remove", flag.ContinueOnError)
+	purge := fs.Bool("purge", false, "also delete the account's metadata and cached files")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: drivefuse accounts remove [-purge] <account>")
+	}
+	if err := cfg.Load(); err != nil {
+		return err
+	}
+	a := findAccount(cfg, fs.Arg(0))
+	if a == nil {
+		return fmt.Errorf("no such account %q", fs.Arg(0))
+	}
+	if *purge {
+		if a.Name == "" {
+			// unnamed accounts share the base data directory
+			return errors.New("-purge is not supported for unnamed accounts")
+		}
+		lock, err := daemon.LockDataDir(cfg)
+		if err != nil {
+			return err
+		}
+		defer lock.Unlock()
+	}
+	accounts := cfg.Accounts[:0]
+	for _, other := range cfg.Accounts {
+		if other != a {
+			accounts = append(accounts, other)
+		}
+	}
+	cfg.Accounts = accounts
+	if err := cfg.Save(); err != nil {
+		return err
+	}
+	if *purge {
+		return os.RemoveAll(cfg.AccountPath(a))
+	}
+	return nil
+}
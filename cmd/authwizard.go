@@ -73,87 +73,136 @@ type question struct {
 	Default string
 }
 
-func readQuestion(opt *question) string {
+func readQuestion(opt *question) (string, error) {
 	var s string
 	for s == "" {
 		fmt.Printf("%v %v [default=%v]>> ", opt.Usage, Bold(opt.Name), Blue(opt.Default))
 		_, err := fmt.Scanln(&s)
 		if err != nil && err.Error() != "unexpected newline" {
-			logger.F("Bad scan.", err)
+			return "", fmt.Errorf("bad scan: %v", err)
 		}
 		if s == "" {
 			s = opt.Default
 		}
 	}
-	return s
+	return s, nil
 }
 
-func listFolders(tr *oauth.Transport) {
+func listFolders(tr *oauth.Transport) error {
 	svc, err := drive.New(tr.Client())
 	if err != nil {
-		logger.F(err)
+		return err
 	}
 	q := "mimeType='application/vnd.google-apps.folder' and trashed=false"
 	// TODO: pagination.
 	files, err := svc.Files.List().Q(q).Do()
 	if err != nil {
-		logger.F(err)
+		return err
 	}
 	for _, f := range files.Items {
 		fmt.Println(f.Title, f.Id)
 	}
+	return nil
 }
 
-func retrieveRefreshToken(act *config.Account) string {
+func retrieveRefreshToken(act *config.Account) (string, error) {
 	tr := auth.NewTransport(act)
 	url := tr.Config.AuthCodeURL("")
 	fmt.Println("Visit this URL to get an authorization code.")
 	fmt.Println(url)
-	code := readQuestion(authorizationCodeQuestion)
+	code, err := readQuestion(authorizationCodeQuestion)
+	if err != nil {
+		return "", err
+	}
 	token, err := tr.Exchange(code)
 	if err != nil {
-		logger.F("Failed to exchange authorization code.", err)
+		return "", fmt.Errorf("failed to exchange authorization code: %v", err)
 	}
-	return token.RefreshToken
+	return token.RefreshToken, nil
 }
 
-func readAccount() *config.Account {
-	cfg := &config.Account{
-		LocalPath:    readQuestion(localPathQuestion),
-		ClientId:     readQuestion(clientIdQuestion),
-		ClientSecret: readQuestion(clientSecretQuestion),
+func readAccount() (cfg *config.Account, err error) {
+	cfg = &config.Account{}
+	for _, q := range []struct {
+		opt *question
+		v   *string
+	}{
+		{accountNameQuestion, &cfg.Name},
+		{localPathQuestion, &cfg.LocalPath},
+		{clientIdQuestion, &cfg.ClientId},
+		{clientSecretQuestion, &cfg.ClientSecret},
+	} {
+		if *q.v, err = readQuestion(q.opt); err != nil {
+			return
+		}
+	}
+	if cfg.RefreshToken, err = retrieveRefreshToken(cfg); err != nil {
+		return
 	}
-	cfg.RefreshToken = retrieveRefreshToken(cfg)
 	for cfg.RemoteId == "" {
-		rid := readQuestion(remoteIdQuestion)
-		if rid == "L" {
-			listFolders(auth.NewTransport(cfg))
-		} else {
+		var rid string
+		if rid, err = readQuestion(remoteIdQuestion); err != nil {
+			return
+		}
+		if rid != "L" {
 			cfg.RemoteId = rid
+		} else if err = listFolders(auth.NewTransport(cfg)); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Keeps the existing accounts, if there is a config already.
+func loadExisting(cfg *config.Config) {
+	if err := cfg.Load(); err != nil && !os.IsNotExist(err) {
+		logger.V("Ignoring the existing configuration.", err)
+		cfg.Accounts = nil
+	}
+}
+
+// Adds a new account to the configuration, replaces the existing
+// account with the same name.
+func readConfig(cfg *config.Config) error {
+	act, err := readAccount()
+	if err != nil {
+		return err
+	}
+	for i, a := range cfg.Accounts {
+		if a.Name == act.Name {
+			cfg.Accounts[i] = act
+			return nil
 		}
 	}
-	return cfg
+	cfg.Accounts = append(cfg.Accounts, act)
+	return nil
 }
 
-func readConfig(cfg *config.Config) {
-	cfg.Accounts = []*config.Account{readAccount()}
+func newSetupCommand() *command {
+	c := newCommand("setup", "",
+		"Runs the setup and authorization wizard.\nAdds an account to the configuration in the data directory.")
+	c.run = func(cfg *config.Config, args []string) error {
+		return runAuthWizard(cfg)
+	}
+	return c
 }
 
 // Run the authorization wizard, generating a config file in the given data
 // directory.
-func RunAuthWizard(cfg *config.Config) {
+func runAuthWizard(cfg *config.Config) error {
 	fmt.Println(messageWelcome)
 	fmt.Println(messageAddAccount)
-	// readConfig will fail loudly by itself, it doesn't return an error
-	readConfig(cfg)
-	err := cfg.Save()
-	if err != nil {
-		logger.F(err)
+	loadExisting(cfg)
+	if err := readConfig(cfg); err != nil {
+		return err
+	}
+	if err := cfg.Save(); err != nil {
+		return err
 	}
 	// Now display the new config to the user.
-	err = cfg.Write(os.Stdout)
-	if err != nil {
-		logger.F(err)
+	if err := cfg.Write(os.Stdout); err != nil {
+		return err
 	}
 	fmt.Println("\nConfig written to", cfg.ConfigPath())
+	return nil
 }
@@ -0,0 +1,94 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/rakyll/drivefuse/blob"
+	"github.com/rakyll/drivefuse/config"
+	"github.com/rakyll/drivefuse/daemon"
+	"github.com/rakyll/drivefuse/metadata"
+)
+
+func newCacheCommand() *command {
+	c := newCommand("cache", "[-clear] [account...]",
+		"Prints or clears the cached files of the accounts.\nAll accounts are included if none are named. Cached files are downloaded\nagain once cleared.")
+	c.loadConfig = true
+	doClear := c.flags.Bool("clear", false, "delete the cached files, the daemon must not be running")
+	c.run = func(cfg *config.Config, args []string) error {
+		accounts, err := selectAccounts(cfg, args)
+		if err != nil {
+			return err
+		}
+		if *doClear {
+			lock, err := daemon.LockDataDir(cfg)
+			if err != nil {
+				return err
+			}
+			defer lock.Unlock()
+			for _, a := range accounts {
+				if err = clearCache(cfg, a); err != nil {
+					return fmt.Errorf("error clearing %s: %v", accountName(a), err)
+				}
+			}
+			return nil
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "ACCOUNT\tFILES\tSIZE")
+		for _, a := range accounts {
+			count, size, err := blob.New(cfg.AccountBlobPath(a), accountName(a)).Usage()
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "%s\t%d\t%s\n", accountName(a), count, formatBytes(size))
+		}
+		return w.Flush()
+	}
+	return c
+}
+
+// Deletes the cached files of an account, queues the synced
+// files to be downloaded again.
+func clearCache(cfg *config.Config, a *config.Account) error {
+	if err := os.RemoveAll(cfg.AccountBlobPath(a)); err != nil {
+		return err
+	}
+	if _, err := os.Stat(cfg.AccountMetadataPath(a)); os.IsNotExist(err) {
+		// never synced
+		return nil
+	}
+	m, err := metadata.New(cfg.AccountMetadataPath(a), nil)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+	return m.QueueDownloads()
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
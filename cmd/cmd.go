@@ -0,0 +1,201 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/rakyll/drivefuse/config"
+)
+
+const (
+	// Command run if none is given.
+	defaultCommand = "mount"
+)
+
+// command is a subcommand of the drivefuse binary, each with
+// its own flags.
+type command struct {
+	name  string
+	args  string
+	short string
+	flags *flag.FlagSet
+
+	// whether the configuration is loaded before running
+	loadConfig bool
+
+	run func(cfg *config.Config, args []string) error
+}
+
+func newCommand(name, args, short string) *command {
+	c := &command{name: name, args: args, short: short}
+	c.flags = flag.NewFlagSet(name, flag.ContinueOnError)
+	c.flags.Usage = c.usage
+	return c
+}
+
+func (c *command) usage() {
+	fmt.Fprintf(os.Stderr, "usage: drivefuse %s %s\n\n%s\n", c.name, c.args, c.short)
+	hasFlags := false
+	c.flags.VisitAll(func(*flag.Flag) { hasFlags = true })
+	if hasFlags {
+		fmt.Fprintln(os.Stderr, "\nflags:")
+		c.flags.PrintDefaults()
+	}
+}
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		newMountCommand(),
+		newUnmountCommand(),
+		newSetupCommand(),
+		newStatusCommand(),
+		newSyncCommand(),
+		newAccountsCommand(),
+		newCacheCommand(),
+		newVersionCommand(),
+		newHelpCommand(),
+	}
+}
+
+func lookupCommand(name string) *command {
+	for _, c := range commands {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func usage(global *flag.FlagSet) {
+	fmt.Fprintln(os.Stderr, "usage: drivefuse [-datadir path] <command> [flags] [args]")
+	printCommands()
+	fmt.Fprintf(os.Stderr, "\n%s is run if no command is given, see drivefuse help <command>\nfor the usage of a command.\n\nflags:\n", defaultCommand)
+	global.PrintDefaults()
+}
+
+func printCommands() {
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", c.name, firstLine(c.short))
+	}
+}
+
+func firstLine(s string) string {
+	if i := strings.Index(s, "\n"); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
+
+func newHelpCommand() *command {
+	c := newCommand("help", "[command]", "Prints the usage of a command.")
+	c.run = func(cfg *config.Config, args []string) error {
+		if len(args) == 0 {
+			fmt.Fprintln(os.Stderr, "usage: drivefuse help <command>")
+			printCommands()
+			return nil
+		}
+		other := lookupCommand(args[0])
+		if other == nil {
+			return errors.New("unknown command " + args[0])
+		}
+		other.usage()
+		return nil
+	}
+	return c
+}
+
+// Main runs the command given by args, the arguments without the
+// program name, and returns the exit code.
+func Main(args []string) int {
+	global := flag.NewFlagSet("drivefuse", flag.ContinueOnError)
+	dataDir := global.String("datadir", config.DefaultDataDir(), "path of the data directory")
+	global.Usage = func() { usage(global) }
+	if err := global.Parse(args); err != nil {
+		return 2
+	}
+	args = global.Args()
+	name := defaultCommand
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	c := lookupCommand(name)
+	if c == nil {
+		fmt.Fprintf(os.Stderr, "drivefuse: unknown command %q\n\n", name)
+		usage(global)
+		return 2
+	}
+	if err := c.flags.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg := config.NewConfig(*dataDir)
+	if err := cfg.Setup(); err != nil {
+		fmt.Fprintln(os.Stderr, "drivefuse: error initializing configuration:", err)
+		return 1
+	}
+	if c.loadConfig {
+		if err := cfg.Load(); err != nil {
+			fmt.Fprintln(os.Stderr, "drivefuse: error reading configuration, did you run setup?", err)
+			return 1
+		}
+	}
+	if err := c.run(cfg, c.flags.Args()); err != nil {
+		fmt.Fprintf(os.Stderr, "drivefuse %s: %v\n", c.name, err)
+		return 1
+	}
+	return 0
+}
+
+// Gets the configured accounts with the given names, all accounts
+// if no names are given. Unnamed accounts are named by their mount
+// points as the daemon does.
+func selectAccounts(cfg *config.Config, names []string) ([]*config.Account, error) {
+	if len(names) == 0 {
+		return cfg.Accounts, nil
+	}
+	var accounts []*config.Account
+	for _, name := range names {
+		a := findAccount(cfg, name)
+		if a == nil {
+			return nil, fmt.Errorf("no such account %q", name)
+		}
+		accounts = append(accounts, a)
+	}
+	return accounts, nil
+}
+
+func findAccount(cfg *config.Config, name string) *config.Account {
+	for _, a := range cfg.Accounts {
+		if a.Name == name || (a.Name == "" && a.LocalPath == name) {
+			return a
+		}
+	}
+	return nil
+}
+
+func accountName(a *config.Account) string {
+	if a.Name == "" {
+		return a.LocalPath
+	}
+	return a.Name
+}
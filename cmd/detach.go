@@ -0,0 +1,91 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/rakyll/drivefuse/config"
+	"github.com/rakyll/drivefuse/daemon"
+	"github.com/rakyll/drivefuse/status"
+)
+
+const (
+	// Set in the environment of the detached process.
+	envDetached = "DRIVEFUSE_DETACHED"
+)
+
+func isDetached() bool {
+	return os.Getenv(envDetached) != ""
+}
+
+// Runs the same command again in a new session, with its output
+// written to the log file. Returns once the detached process has
+// started its accounts, which might take long if it blocks on a sync.
+func runDetached(cfg *config.Config) error {
+	// fail here rather than in the background
+	lock, err := daemon.LockDataDir(cfg)
+	if err != nil {
+		return err
+	}
+	lock.Unlock()
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	logFile, err := os.OpenFile(cfg.LogPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+	c := exec.Command(exe, os.Args[1:]...)
+	c.Env = append(os.Environ(), envDetached+"=1")
+	c.Stdout, c.Stderr = logFile, logFile
+	c.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err = c.Start(); err != nil {
+		return err
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- c.Wait()
+	}()
+	client := status.NewClient(cfg.ControlPath())
+	for {
+		select {
+		case err := <-exited:
+			return fmt.Errorf("daemon exited (%v), see %s", err, cfg.LogPath())
+		case <-time.After(100 * time.Millisecond):
+		}
+		if statuses, err := client.Status(); err == nil && !isStarting(statuses) {
+			fmt.Printf("drivefuse is running in the background with pid %d, logging to %s\n", c.Process.Pid, cfg.LogPath())
+			return nil
+		}
+	}
+}
+
+func isStarting(statuses []*daemon.AccountStatus) bool {
+	for _, s := range statuses {
+		if s.IsStarting() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,146 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/rakyll/drivefuse/config"
+	"github.com/rakyll/drivefuse/daemon"
+	"github.com/rakyll/drivefuse/logger"
+	"github.com/rakyll/drivefuse/metrics"
+	"github.com/rakyll/drivefuse/mount"
+	"github.com/rakyll/drivefuse/status"
+)
+
+func newMountCommand() *command {
+	c := newCommand("mount", "[-daemon] [-blocksync] [-mountpoint path] [account...]",
+		"Syncs and mounts the accounts until interrupted.\nAll accounts are mounted if none are named. The process id is written to\ndrivefuse.pid in the data directory. With -daemon, runs in the background\nand logs to drivefuse.log in the data directory.")
+	c.loadConfig = true
+	detach := c.flags.Bool("daemon", false, "detach and run in the background")
+	blockSync := c.flags.Bool("blocksync", false, "block until a full sync is done before mounting")
+	mountPoint := c.flags.String("mountpoint", "", "mount point, overrides the configured one of a single account")
+	c.run = func(cfg *config.Config, args []string) error {
+		accounts, err := selectAccounts(cfg, args)
+		if err != nil {
+			return err
+		}
+		if *mountPoint != "" {
+			if len(accounts) != 1 {
+				return errors.New("-mountpoint requires a single account")
+			}
+			accounts[0].LocalPath = *mountPoint
+		}
+		cfg.Accounts = accounts
+		if *detach && !isDetached() {
+			return runDetached(cfg)
+		}
+		return runDaemon(cfg, *blockSync)
+	}
+	return c
+}
+
+// Runs the daemon for the configured accounts until it's
+// interrupted.
+func runDaemon(cfg *config.Config, blockSync bool) error {
+	lock, err := daemon.LockDataDir(cfg)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	if err = daemon.WritePid(cfg); err != nil {
+		return err
+	}
+	defer os.Remove(cfg.PidPath())
+
+	// served while the accounts are started, the initial syncs
+	// might take long
+	d := daemon.New(cfg)
+	ctl, err := status.StartUnix(cfg.ControlPath(), d)
+	if err != nil {
+		return fmt.Errorf("error listening on the control socket: %v", err)
+	}
+	var srv *status.Server
+	if addr := cfg.StatusAddress(); addr != "" {
+		if srv, err = status.Start(addr, cfg.StatusTokenPath(), d); err != nil {
+			logger.V("Error starting the status service.", err)
+		}
+	}
+	if cfg.MetricsAddr != "" {
+		if _, err = metrics.Serve(cfg.MetricsAddr); err != nil {
+			logger.V("Error serving metrics.", err)
+		}
+	}
+	if err = d.Start(blockSync); err != nil {
+		closeServers(ctl, srv)
+		return err
+	}
+	return gracefulShutDown(d, ctl, srv)
+}
+
+// Waits for a signal, unmounts the accounts once the requests and
+// downloads in progress are done. A second signal exits right away.
+func gracefulShutDown(d *daemon.Daemon, ctl *status.Server, srv *status.Server) error {
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
+
+	<-c
+	logger.V("Gracefully shutting down, interrupt again to force...")
+	go func() {
+		<-c
+		logger.V("Forced to shut down, unmount manually if needed.")
+		os.Exit(1)
+	}()
+	closeServers(ctl, srv)
+	return d.Stop()
+}
+
+func closeServers(ctl *status.Server, srv *status.Server) {
+	ctl.Close()
+	if srv != nil {
+		srv.Close()
+	}
+}
+
+func newUnmountCommand() *command {
+	c := newCommand("unmount", "[account...]",
+		"Unmounts the accounts.\nAll accounts are unmounted if none are named. Mounts left behind by a\ndaemon that is not running are unmounted directly.")
+	c.loadConfig = true
+	c.run = func(cfg *config.Config, args []string) error {
+		accounts, err := selectAccounts(cfg, args)
+		if err != nil {
+			return err
+		}
+		client := status.NewClient(cfg.ControlPath())
+		_, err = client.Status()
+		isRunning := err == nil
+		for _, a := range accounts {
+			if isRunning {
+				err = client.Unmount(accountName(a))
+			} else {
+				err = mount.Umount(a.LocalPath)
+			}
+			if err != nil {
+				return fmt.Errorf("error unmounting %s: %v", accountName(a), err)
+			}
+		}
+		return nil
+	}
+	return c
+}
@@ -0,0 +1,113 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/rakyll/drivefuse/config"
+	"github.com/rakyll/drivefuse/daemon"
+	"github.com/rakyll/drivefuse/status"
+)
+
+const (
+	layoutTime = "2006-01-02 15:04:05"
+)
+
+func newStatusCommand() *command {
+	c := newCommand("status", "[-json]",
+		"Prints the state of the running daemon's accounts.")
+	asJSON := c.flags.Bool("json", false, "print the status as JSON")
+	c.run = func(cfg *config.Config, args []string) error {
+		statuses, err := status.NewClient(cfg.ControlPath()).Status()
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(statuses)
+		}
+		for i, s := range statuses {
+			if i > 0 {
+				fmt.Println()
+			}
+			printStatus(os.Stdout, s)
+		}
+		return nil
+	}
+	return c
+}
+
+func newSyncCommand() *command {
+	c := newCommand("sync", "[account...]",
+		"Runs a full sync of the running daemon's accounts.\nAll accounts are synced if none are named, waits until it's done.")
+	c.loadConfig = true
+	c.run = func(cfg *config.Config, args []string) error {
+		accounts, err := selectAccounts(cfg, args)
+		if err != nil {
+			return err
+		}
+		client := status.NewClient(cfg.ControlPath())
+		for _, a := range accounts {
+			fmt.Println("Syncing", accountName(a))
+			if err = client.Sync(accountName(a)); err != nil {
+				return fmt.Errorf("error syncing %s: %v", accountName(a), err)
+			}
+		}
+		return nil
+	}
+	return c
+}
+
+func printStatus(w io.Writer, s *daemon.AccountStatus) {
+	state := s.State
+	if s.Paused {
+		state += ", paused"
+	}
+	fmt.Fprintf(w, "%s (%s)\n", Bold(s.Name), state)
+	fmt.Fprintf(w, "  mount point: %s\n", s.LocalPath)
+	if s.Error != "" {
+		fmt.Fprintf(w, "  error:       %s\n", s.Error)
+	}
+	lastSync := "never"
+	if !s.LastSync.IsZero() {
+		lastSync = formatTime(s.LastSync)
+	}
+	fmt.Fprintf(w, "  last sync:   %s\n", lastSync)
+	fmt.Fprintf(w, "  downloads:   %d queued\n", s.PendingDownloads)
+	fmt.Fprintf(w, "  uploads:     %d queued\n", s.PendingUploads)
+	fmt.Fprintf(w, "  changes:     %d to replay\n", s.PendingChanges)
+	if len(s.RecentErrors) > 0 {
+		fmt.Fprintln(w, "  failures:")
+		for _, e := range s.RecentErrors {
+			fmt.Fprintf(w, "    %s %s %s %s\n", formatTime(e.Time), e.Type, e.RemoteId, e.Message)
+		}
+	}
+	if len(s.RecentConflicts) > 0 {
+		fmt.Fprintln(w, "  conflicts:")
+		for _, c := range s.RecentConflicts {
+			fmt.Fprintf(w, "    %s %s %s\n", formatTime(c.Time), c.Name, c.RemoteId)
+		}
+	}
+}
+
+func formatTime(t time.Time) string {
+	return t.Local().Format(layoutTime)
+}
@@ -0,0 +1,35 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/rakyll/drivefuse/config"
+)
+
+// Version of drivefuse, set at build time with
+// -ldflags "-X github.com/rakyll/drivefuse/cmd.Version=<version>".
+var Version = "devel"
+
+func newVersionCommand() *command {
+	c := newCommand("version", "", "Prints the version of drivefuse.")
+	c.run = func(cfg *config.Config, args []string) error {
+		fmt.Printf("drivefuse %s (%s %s/%s)\n", Version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+		return nil
+	}
+	return c
+}
@@ -23,6 +23,8 @@ import (
 	"os"
 	"os/user"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/rakyll/drivefuse/logger"
 )
@@ -36,6 +38,34 @@ const (
 
 	// Name of the blob directory.
 	blobName = "blob"
+
+	// Name of the directory containing per-account data directories.
+	accountsName = "accounts"
+
+	// Name of the global ignore file.
+	ignoreName = "ignore"
+
+	// Name of the control socket of a running daemon.
+	controlName = "control.sock"
+
+	// Name of the lock file held by the instance owning the data
+	// directory.
+	lockName = "lock"
+
+	// Names of the pid file of the running daemon and the log
+	// file of a detached daemon.
+	pidName = "drivefuse.pid"
+	logName = "drivefuse.log"
+
+	// Name of the file holding the token to control syncing through
+	// the status service.
+	statusTokenName = "status.token"
+
+	// Address the status service listens on by default.
+	defaultStatusAddr = "127.0.0.1:8786"
+
+	// Disables the status service if set as the address.
+	statusAddrOff = "off"
 )
 
 // DefaultMountpoint gets the default local path to mount to for a user.
@@ -61,12 +91,27 @@ func HomeDir(path ...string) string {
 // Account is the configuration of a single account.
 type Account struct {
 
+	// Name of the account, used to name its data directory.
+	Name string `json:"name,omitempty"`
+
 	// Local path where a Drive directory will be mounted.
 	LocalPath string `json:"local_path"`
 
 	// File ID of the remote folder to be synced.
 	RemoteId string `json:"remote_id"`
 
+	// Whether to serve the items shared with the user under
+	// the "Shared with me" folder, changes of the shared items
+	// in the synced folder are merged as well.
+	SharedWithMe bool `json:"shared_with_me,omitempty"`
+
+	// Rules select the files to be synced, the first matching
+	// rule applies. Files are synced if no rules match.
+	Rules []Rule `json:"rules,omitempty"`
+
+	// Hooks are commands run on sync events.
+	Hooks []Hook `json:"hooks,omitempty"`
+
 	// OAuth 2.0 Client ID for authorization and token refreshing.
 	ClientId string `json:"client_id"`
 
@@ -77,8 +122,22 @@ type Account struct {
 	RefreshToken string `json:"refresh_token"`
 }
 
-// Validate tests whether all required fields are present.
+// Validate tests whether all required fields are present, the
+// name is usable as a directory name and the rules and hooks are valid.
 func (a *Account) Validate() bool {
+	if strings.ContainsRune(a.Name, filepath.Separator) || a.Name == "." || a.Name == ".." {
+		return false
+	}
+	for i := range a.Rules {
+		if !a.Rules[i].Validate() {
+			return false
+		}
+	}
+	for i := range a.Hooks {
+		if !a.Hooks[i].Validate() {
+			return false
+		}
+	}
 	return a.LocalPath != "" &&
 		a.RemoteId != "" &&
 		a.ClientId != "" &&
@@ -94,6 +153,24 @@ type Config struct {
 
 	// Accounts are the configured accounts.
 	Accounts []*Account `json:"accounts"`
+
+	// Seconds the kernel caches file attributes for, zero for the default.
+	AttrValid int `json:"attr_valid,omitempty"`
+
+	// Seconds the kernel caches directory entries for, zero for the default.
+	EntryValid int `json:"entry_valid,omitempty"`
+
+	// Number of hooks allowed to run at once for each account,
+	// zero for the default.
+	HookConcurrency int `json:"hook_concurrency,omitempty"`
+
+	// Address of the local HTTP status service, "off" to disable it.
+	// POST requests need the token written to the data directory.
+	StatusAddr string `json:"status_addr,omitempty"`
+
+	// Address to export the metrics on in the Prometheus text
+	// format, metrics are only served by the status service if empty.
+	MetricsAddr string `json:"metrics_addr,omitempty"`
 }
 
 // NewConfig creates a new configuration in a given directory.
@@ -110,10 +187,18 @@ func (c *Config) Validate() bool {
 	if len(c.Accounts) == 0 {
 		return false
 	}
+	names := make(map[string]bool)
+	paths := make(map[string]bool)
 	for _, a := range c.Accounts {
 		if !a.Validate() {
 			return false
 		}
+		// accounts can't share data directories or mount points
+		if names[a.Name] || paths[a.LocalPath] {
+			return false
+		}
+		names[a.Name] = true
+		paths[a.LocalPath] = true
 	}
 	return true
 }
@@ -174,11 +259,43 @@ func (c *Config) Read(r io.Reader) error {
 	return json.NewDecoder(r).Decode(c)
 }
 
-// Hack while we only support one account
+// AttrValidDuration is the duration the kernel caches file attributes for.
+func (c *Config) AttrValidDuration() time.Duration {
+	return time.Duration(c.AttrValid) * time.Second
+}
+
+// EntryValidDuration is the duration the kernel caches directory entries for.
+func (c *Config) EntryValidDuration() time.Duration {
+	return time.Duration(c.EntryValid) * time.Second
+}
+
+// StatusAddress is the address the status service listens on,
+// empty if the service is disabled.
+func (c *Config) StatusAddress() string {
+	switch c.StatusAddr {
+	case "":
+		return defaultStatusAddr
+	case statusAddrOff:
+		return ""
+	}
+	return c.StatusAddr
+}
+
+// FirstAccount gets the first configured account.
 func (c *Config) FirstAccount() *Account {
 	return c.Accounts[0]
 }
 
+// Account gets the account with the given name, nil if there is none.
+func (c *Config) Account(name string) *Account {
+	for _, a := range c.Accounts {
+		if a.Name == name {
+			return a
+		}
+	}
+	return nil
+}
+
 // DataPath generates a path relative to the data directory.
 func (c *Config) DataPath(path ...string) string {
 	path = append([]string{c.DataDir}, path...)
@@ -199,3 +316,56 @@ func (c *Config) BlobPath() string {
 func (c *Config) MetadataPath() string {
 	return c.DataPath(metaName)
 }
+
+// IgnorePath is the path to the ignore file applied to all accounts.
+func (c *Config) IgnorePath() string {
+	return c.DataPath(ignoreName)
+}
+
+// ControlPath is the path to the Unix socket a running daemon
+// is controlled through.
+func (c *Config) ControlPath() string {
+	return c.DataPath(controlName)
+}
+
+// StatusTokenPath is the path to the file holding the token
+// of the running status service.
+func (c *Config) StatusTokenPath() string {
+	return c.DataPath(statusTokenName)
+}
+
+// LockPath is the path to the lock file of the data directory.
+func (c *Config) LockPath() string {
+	return c.DataPath(lockName)
+}
+
+// PidPath is the path to the pid file of the running daemon.
+func (c *Config) PidPath() string {
+	return c.DataPath(pidName)
+}
+
+// LogPath is the path to the log file of a detached daemon.
+func (c *Config) LogPath() string {
+	return c.DataPath(logName)
+}
+
+// AccountPath generates a path relative to an account's data directory.
+// Unnamed accounts use the base data directory, as single account
+// setups always did.
+func (c *Config) AccountPath(a *Account, path ...string) string {
+	if a.Name == "" {
+		return c.DataPath(path...)
+	}
+	path = append([]string{accountsName, a.Name}, path...)
+	return c.DataPath(path...)
+}
+
+// AccountBlobPath is the path to the blob directory of an account.
+func (c *Config) AccountBlobPath(a *Account) string {
+	return c.AccountPath(a, blobName)
+}
+
+// AccountMetadataPath is the path to the metadata database of an account.
+func (c *Config) AccountMetadataPath(a *Account) string {
+	return c.AccountPath(a, metaName)
+}
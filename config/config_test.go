@@ -18,7 +18,9 @@ package config
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	T "github.com/rakyll/drivefuse/third_party/launchpad.net/gocheck"
 )
@@ -149,6 +151,66 @@ func (s *ConfigSuite) TestDataDirPath(c *T.C) {
 	c.Assert(filepath.Join(s.dataDir, configName), T.Equals, cfg.ConfigPath())
 }
 
+func (s *ConfigSuite) TestValidDurations(c *T.C) {
+	cfg := NewConfig(s.dataDir)
+	c.Assert(cfg.AttrValidDuration(), T.Equals, time.Duration(0))
+	err := cfg.Read(strings.NewReader(`{"attr_valid": 5, "entry_valid": 30}`))
+	c.Assert(err, T.IsNil)
+	c.Assert(cfg.AttrValidDuration(), T.Equals, 5*time.Second)
+	c.Assert(cfg.EntryValidDuration(), T.Equals, 30*time.Second)
+}
+
+func (s *ConfigSuite) TestAccountPaths(c *T.C) {
+	cfg := NewConfig(s.dataDir)
+	c.Assert(cfg.AccountMetadataPath(&Account{}), T.Equals, cfg.MetadataPath())
+	c.Assert(cfg.AccountBlobPath(&Account{Name: "work"}), T.Equals, filepath.Join(s.dataDir, accountsName, "work", blobName))
+}
+
+func (s *ConfigSuite) TestDuplicateAccounts(c *T.C) {
+	cfg := NewConfig(s.dataDir)
+	err := cfg.Read(strings.NewReader(testGoodFile))
+	c.Assert(err, T.IsNil)
+	act := *cfg.FirstAccount()
+	act.LocalPath = "/tmp/other"
+	cfg.Accounts = append(cfg.Accounts, &act)
+	c.Assert(cfg.Validate(), T.Equals, false)
+	act.Name = "work"
+	c.Assert(cfg.Validate(), T.Equals, true)
+	c.Assert(cfg.Account("work"), T.Equals, &act)
+}
+
+func (s *ConfigSuite) TestRules(c *T.C) {
+	rules := []Rule{
+		{Path: "Photos/Raw", Action: RuleHide},
+		{Path: "Photos", MimeType: "video/*", Action: RuleExclude},
+		{Path: "*.iso", Action: RuleExclude},
+	}
+	c.Assert(MatchRules(rules, "Photos/Raw/a.nef", "image/x-nikon-nef"), T.Equals, RuleHide)
+	c.Assert(MatchRules(rules, "Photos/2013/a.mp4", "video/mp4"), T.Equals, RuleExclude)
+	c.Assert(MatchRules(rules, "Photos/2013/a.mp4", ""), T.Equals, RuleInclude)
+	c.Assert(MatchRules(rules, "Photos/a.jpg", "image/jpeg"), T.Equals, RuleInclude)
+	c.Assert(MatchRules(rules, "ubuntu.iso", ""), T.Equals, RuleExclude)
+	c.Assert(MatchRules(rules, "Backups/ubuntu.iso", ""), T.Equals, RuleInclude)
+	c.Assert((&Rule{Path: "[", Action: RuleHide}).Validate(), T.Equals, false)
+	c.Assert((&Rule{Path: "a"}).Validate(), T.Equals, false)
+}
+
+func (s *ConfigSuite) TestHooks(c *T.C) {
+	hook := &Hook{Path: "builds", Events: []string{HookDownloaded}, Command: []string{"make"}}
+	c.Assert(hook.Validate(), T.Equals, true)
+	c.Assert(hook.Match(HookDownloaded, "builds/src/main.c"), T.Equals, true)
+	c.Assert(hook.Match(HookDeleted, "builds/src/main.c"), T.Equals, false)
+	c.Assert(hook.Match(HookDownloaded, "docs/main.c"), T.Equals, false)
+	c.Assert(hook.TimeoutDuration(), T.Equals, defaultHookTimeout)
+	c.Assert((&Hook{Events: []string{"changed"}, Command: []string{"make"}}).Validate(), T.Equals, false)
+}
+
+func (s *ConfigSuite) TestStatusAddress(c *T.C) {
+	c.Assert((&Config{}).StatusAddress(), T.Equals, defaultStatusAddr)
+	c.Assert((&Config{StatusAddr: "off"}).StatusAddress(), T.Equals, "")
+	c.Assert((&Config{StatusAddr: "127.0.0.1:9000"}).StatusAddress(), T.Equals, "127.0.0.1:9000")
+}
+
 func (s *ConfigSuite) TestFailing(c *T.C) {
 	c.Error(1)
 }
@@ -0,0 +1,96 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"path"
+	"time"
+)
+
+const (
+	HookDownloaded = "downloaded"
+	HookUploaded   = "uploaded"
+	HookDeleted    = "deleted"
+	HookConflict   = "conflict"
+
+	defaultHookTimeout     = 60 * time.Second
+	defaultHookConcurrency = 4
+)
+
+// Hook is a command run when a synced file matching its pattern
+// is downloaded, uploaded, deleted or conflicted. The local path and
+// Drive id of the file are appended to the arguments.
+type Hook struct {
+
+	// Glob pattern matched against the path relative to the mount
+	// point, as in rules. Matches all files if empty.
+	Path string `json:"path,omitempty"`
+
+	// Events the hook is run for.
+	Events []string `json:"events"`
+
+	// Command and its arguments.
+	Command []string `json:"command"`
+
+	// Seconds the command is allowed to run for, zero for the default.
+	Timeout int `json:"timeout,omitempty"`
+}
+
+// Validate tests whether the events are known, the pattern is
+// valid and there is a command.
+func (h *Hook) Validate() bool {
+	if len(h.Command) == 0 || len(h.Events) == 0 {
+		return false
+	}
+	for _, e := range h.Events {
+		switch e {
+		case HookDownloaded, HookUploaded, HookDeleted, HookConflict:
+		default:
+			return false
+		}
+	}
+	_, err := path.Match(h.Path, "")
+	return err == nil
+}
+
+// Match tests whether the hook is run for event on the file at p.
+func (h *Hook) Match(event string, p string) bool {
+	if h.Path != "" && !matchPath(h.Path, p) {
+		return false
+	}
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// TimeoutDuration is the duration the command is allowed to run for.
+func (h *Hook) TimeoutDuration() time.Duration {
+	if h.Timeout <= 0 {
+		return defaultHookTimeout
+	}
+	return time.Duration(h.Timeout) * time.Second
+}
+
+// HookConcurrencyLimit is the number of hooks allowed to run at once
+// for each account.
+func (c *Config) HookConcurrencyLimit() int {
+	if c.HookConcurrency <= 0 {
+		return defaultHookConcurrency
+	}
+	return c.HookConcurrency
+}
@@ -0,0 +1,92 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"path"
+)
+
+const (
+	// Files are synced and cached.
+	RuleInclude = "include"
+
+	// Files are listed, but never downloaded ahead of time.
+	RuleExclude = "exclude"
+
+	// Files are neither listed nor downloaded.
+	RuleHide = "hide"
+)
+
+// Rule selects the files matching its patterns for an action. A rule
+// without any patterns matches all files.
+type Rule struct {
+
+	// Glob pattern, as in path.Match, matched against the slash separated
+	// path relative to the mount point. A folder's rule applies to
+	// everything under the folder.
+	Path string `json:"path,omitempty"`
+
+	// Glob pattern matched against the MIME type, e.g. "video/*".
+	MimeType string `json:"mime_type,omitempty"`
+
+	// One of include, exclude or hide.
+	Action string `json:"action"`
+}
+
+// Validate tests whether the action is known and patterns are valid.
+func (r *Rule) Validate() bool {
+	switch r.Action {
+	case RuleInclude, RuleExclude, RuleHide:
+	default:
+		return false
+	}
+	if _, err := path.Match(r.Path, ""); err != nil {
+		return false
+	}
+	_, err := path.Match(r.MimeType, "")
+	return err == nil
+}
+
+// Match tests whether the file at p with the given MIME type matches
+// the rule. An empty mimeType doesn't match rules with a MIME pattern.
+func (r *Rule) Match(p string, mimeType string) bool {
+	if r.MimeType != "" {
+		if ok, _ := path.Match(r.MimeType, mimeType); !ok {
+			return false
+		}
+	}
+	return r.Path == "" || matchPath(r.Path, p)
+}
+
+// Tests whether p or one of its folders matches pattern.
+func matchPath(pattern string, p string) bool {
+	for p = path.Clean("/" + p); p != "/"; p = path.Dir(p) {
+		if ok, _ := path.Match(pattern, p[1:]); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchRules gets the action of the first rule matching the file at p,
+// files are included if no rules match.
+func MatchRules(rules []Rule, p string, mimeType string) string {
+	for i := range rules {
+		if rules[i].Match(p, mimeType) {
+			return rules[i].Action
+		}
+	}
+	return RuleInclude
+}
@@ -0,0 +1,242 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rakyll/drivefuse/auth"
+	"github.com/rakyll/drivefuse/blob"
+	"github.com/rakyll/drivefuse/config"
+	"github.com/rakyll/drivefuse/events"
+	"github.com/rakyll/drivefuse/hooks"
+	"github.com/rakyll/drivefuse/logger"
+	"github.com/rakyll/drivefuse/metadata"
+	"github.com/rakyll/drivefuse/mount"
+	"github.com/rakyll/drivefuse/syncer"
+	"github.com/rakyll/drivefuse/third_party/code.google.com/p/goauth2/oauth"
+)
+
+const (
+	StateStopped = iota
+	StateRunning
+	StateFailed
+	StateStarting // waiting for the initial sync
+)
+
+const (
+	// Time to wait for the requests being handled once unmounted.
+	timeoutServed = 10 * time.Second
+)
+
+var (
+	errUnmounted    = errors.New("unmounted externally")
+	errStillMounted = errors.New("still mounted, retry once it's unmounted")
+)
+
+// Account runs an isolated stack for a single configured account:
+// its own metadata database, blob directory, transport, syncer and
+// mount. Failure of an account doesn't affect the others.
+type Account struct {
+	Config *config.Account
+
+	cfg         *config.Config
+	transport   *oauth.Transport
+	metaService *metadata.MetaService
+	blobManager *blob.Manager
+	syncer      *syncer.CachedSyncer
+	hooks       *hooks.Runner
+	bus         *events.Bus
+
+	state int
+	err   error
+
+	// closed once the mount is no longer served
+	served chan struct{}
+
+	lastSync        time.Time
+	recentErrors    []*ErrorInfo
+	recentConflicts []*ConflictInfo
+	muStatus        sync.Mutex
+
+	mu sync.Mutex
+}
+
+func newAccount(cfg *config.Config, act *config.Account) *Account {
+	a := &Account{Config: act, cfg: cfg}
+	a.bus = events.New(a.Name())
+	a.bus.Subscribe(func(e *events.Event) {
+		logger.D(e)
+	})
+	a.bus.Subscribe(a.track)
+	return a
+}
+
+// Name is the account's name, or its mount point if the account
+// is not named.
+func (a *Account) Name() string {
+	if a.Config.Name == "" {
+		return a.Config.LocalPath
+	}
+	return a.Config.Name
+}
+
+// Events gets the bus the account's activity is published to,
+// subscriptions are kept if the account is restarted.
+func (a *Account) Events() *events.Bus {
+	return a.bus
+}
+
+// State gets the current state of the account and the error
+// that caused it to fail, if any.
+func (a *Account) State() (state int, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.state, a.err
+}
+
+// Starts syncing and mounts the account, returns once the account
+// is mounted. Blocks until a full sync is done if blockSync is set,
+// the account isn't locked meanwhile.
+func (a *Account) Start(blockSync bool) (err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.state == StateRunning || a.state == StateStarting {
+		return nil
+	}
+	if a.served != nil {
+		select {
+		case <-a.served:
+		default:
+			// a previous stop failed to unmount
+			return errStillMounted
+		}
+	}
+	defer func() {
+		if err != nil {
+			a.state, a.err = StateFailed, err
+		}
+	}()
+
+	if err = os.MkdirAll(a.cfg.AccountBlobPath(a.Config), 0750); err != nil {
+		return
+	}
+	if a.metaService, err = metadata.New(a.cfg.AccountMetadataPath(a.Config), a.bus); err != nil {
+		return
+	}
+	a.blobManager = blob.New(a.cfg.AccountBlobPath(a.Config), a.Name())
+	a.transport = auth.NewTransport(a.Config)
+	a.transport.Transport = &instrumentedTransport{account: a.Name(), transport: a.transport.Transport}
+	a.exportQueues()
+	a.syncer = syncer.NewCachedSyncer(a.transport, a.Config, a.metaService, a.blobManager, a.bus)
+	a.hooks = hooks.Start(a.Config, a.metaService, a.bus, a.cfg.HookConcurrencyLimit())
+	if blockSync {
+		a.state, a.err = StateStarting, nil
+		a.mu.Unlock()
+		a.syncer.Sync(true)
+		a.mu.Lock()
+		if a.state != StateStarting {
+			// stopped while syncing
+			a.teardown()
+			return nil
+		}
+	}
+	a.syncer.Start()
+
+	logger.V("mounting", a.Name(), "at", a.Config.LocalPath)
+	var fs *mount.GoogleDriveFS
+	fs, err = mount.Mount(
+		a.Config.LocalPath,
+		a.metaService,
+		a.blobManager,
+		a.transport,
+		&mount.Options{
+			RemoteId:     a.Config.RemoteId,
+			AttrValid:    a.cfg.AttrValidDuration(),
+			EntryValid:   a.cfg.EntryValidDuration(),
+			SharedWithMe: a.Config.SharedWithMe,
+			IgnorePath:   a.cfg.IgnorePath(),
+			Bus:          a.bus,
+		})
+	if err != nil {
+		a.teardown()
+		return
+	}
+	a.state, a.err = StateRunning, nil
+	a.served = make(chan struct{})
+	go a.serve(fs)
+	return nil
+}
+
+// Unmounts the account and stops syncing. The account is torn down
+// once the requests being handled are done, waits for them for
+// a while.
+func (a *Account) Stop() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.state == StateStarting {
+		// torn down once the initial sync is done
+		a.state = StateStopped
+		return nil
+	}
+	if a.state != StateRunning {
+		return nil
+	}
+	logger.V("stopping", a.Name())
+	a.state, a.err = StateStopped, nil
+	if err := mount.Umount(a.Config.LocalPath); err != nil {
+		// torn down once it's unmounted
+		return err
+	}
+	select {
+	case <-a.served:
+		return nil
+	case <-time.After(timeoutServed):
+		return fmt.Errorf("%s is unmounted, but requests are still being handled", a.Config.LocalPath)
+	}
+}
+
+// Serves the mount until it's unmounted and tears the account down,
+// marks the account as failed if it's not stopped by Stop.
+func (a *Account) serve(fs *mount.GoogleDriveFS) {
+	err := fs.Serve()
+	// no requests are being handled, the metadata can be closed
+	a.teardown()
+	close(a.served)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.state != StateRunning {
+		return
+	}
+	if err == nil {
+		err = errUnmounted
+	}
+	logger.V("error serving", a.Name(), err)
+	a.state, a.err = StateFailed, err
+}
+
+func (a *Account) teardown() {
+	a.syncer.Stop()
+	a.hooks.Stop()
+	a.unexportQueues()
+	if err := a.metaService.Close(); err != nil {
+		logger.V(err)
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package daemon runs the configured accounts side by side.
+package daemon
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/rakyll/drivefuse/config"
+	"github.com/rakyll/drivefuse/logger"
+)
+
+// Daemon manages a stack for each of the configured accounts.
+type Daemon struct {
+	Accounts []*Account
+}
+
+// New creates a daemon for the accounts in cfg.
+func New(cfg *config.Config) *Daemon {
+	d := &Daemon{}
+	for _, act := range cfg.Accounts {
+		d.Accounts = append(d.Accounts, newAccount(cfg, act))
+	}
+	return d
+}
+
+// Starts all accounts. Failing accounts are logged and skipped,
+// returns an error only if none of the accounts could be started.
+func (d *Daemon) Start(blockSync bool) error {
+	started := 0
+	for _, a := range d.Accounts {
+		if err := a.Start(blockSync); err != nil {
+			logger.V("error starting", a.Name(), err)
+			continue
+		}
+		started++
+	}
+	if started == 0 {
+		return errors.New("no accounts could be started")
+	}
+	return nil
+}
+
+// Stops all accounts, returns the first error encountered. Accounts
+// failing to stop don't prevent the others from being stopped.
+func (d *Daemon) Stop() (err error) {
+	for _, a := range d.Accounts {
+		if stopErr := a.Stop(); stopErr != nil {
+			logger.V("error stopping", a.Name(), stopErr)
+			if err == nil {
+				err = fmt.Errorf("error stopping %s: %v", a.Name(), stopErr)
+			}
+		}
+	}
+	return
+}
+
+// Account gets the account with the given name, nil if there is none.
+func (d *Daemon) Account(name string) *Account {
+	for _, a := range d.Accounts {
+		if a.Name() == name {
+			return a
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/rakyll/drivefuse/config"
+)
+
+// Lock is an exclusive lock on a data directory, no two instances
+// should share the metadata and blobs in it. It's released by the
+// kernel if the process exits without unlocking.
+type Lock struct {
+	f *os.File
+}
+
+// Locks the data directory of cfg, fails if another instance
+// owns it.
+func LockDataDir(cfg *config.Config) (*Lock, error) {
+	f, err := os.OpenFile(cfg.LockPath(), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, lockedError(cfg)
+		}
+		return nil, err
+	}
+	return &Lock{f: f}, nil
+}
+
+// Releases the lock.
+func (l *Lock) Unlock() error {
+	return l.f.Close()
+}
+
+func lockedError(cfg *config.Config) error {
+	msg := "another instance owns the data directory " + cfg.DataDir
+	if pid, err := ReadPid(cfg); err == nil {
+		msg += fmt.Sprintf(" (pid %d)", pid)
+	}
+	return errors.New(msg)
+}
+
+// Writes the process id to the pid file of the data directory,
+// it's only written by the lock owner.
+func WritePid(cfg *config.Config) error {
+	return ioutil.WriteFile(cfg.PidPath(), []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+// Gets the process id of the lock owner from the pid file.
+func ReadPid(cfg *config.Config) (int, error) {
+	data, err := ioutil.ReadFile(cfg.PidPath())
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
@@ -0,0 +1,109 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rakyll/drivefuse/metadata"
+	"github.com/rakyll/drivefuse/metrics"
+)
+
+var (
+	apiRequests = metrics.NewCounter(
+		"drivefuse_api_requests_total",
+		"Requests made to Drive by status code, code is \"error\" if no response is received.",
+		"account", "code")
+	apiLatency = metrics.NewHistogram(
+		"drivefuse_api_request_duration_seconds",
+		"Time taken to receive the response headers of requests made to Drive.",
+		metrics.DefBuckets, "account")
+	bytesSent = metrics.NewCounter(
+		"drivefuse_sent_bytes_total",
+		"Bytes of request bodies sent to Drive.",
+		"account")
+	bytesReceived = metrics.NewCounter(
+		"drivefuse_received_bytes_total",
+		"Bytes of response bodies received from Drive.",
+		"account")
+	queueDepth = metrics.NewGauge(
+		"drivefuse_queue_depth",
+		"Number of files queued by operation.",
+		"account", "op")
+)
+
+var queueOps = map[string]int{
+	"download": metadata.OpDownload,
+	"fetch":    metadata.OpFetch,
+	"upload":   metadata.OpUpload,
+}
+
+// Exports the depths of the account's queues, they are counted
+// each time the metrics are collected.
+func (a *Account) exportQueues() {
+	m := a.metaService
+	for name, op := range queueOps {
+		op := op
+		queueDepth.SetFunc(func() float64 {
+			n, _ := m.CountByOp(op)
+			return float64(n)
+		}, a.Name(), name)
+	}
+}
+
+func (a *Account) unexportQueues() {
+	for name := range queueOps {
+		queueDepth.Delete(a.Name(), name)
+	}
+}
+
+// instrumentedTransport counts the requests and bytes transferred
+// by an account.
+type instrumentedTransport struct {
+	account   string
+	transport http.RoundTripper
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.ContentLength > 0 {
+		bytesSent.Add(float64(req.ContentLength), t.account)
+	}
+	start := time.Now()
+	resp, err := t.transport.RoundTrip(req)
+	apiLatency.ObserveSince(start, t.account)
+	if err != nil {
+		apiRequests.Inc(t.account, "error")
+		return nil, err
+	}
+	apiRequests.Inc(t.account, strconv.Itoa(resp.StatusCode))
+	resp.Body = &countingBody{ReadCloser: resp.Body, account: t.account}
+	return resp, nil
+}
+
+type countingBody struct {
+	io.ReadCloser
+	account string
+}
+
+func (b *countingBody) Read(p []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(p)
+	if n > 0 {
+		bytesReceived.Add(float64(n), b.account)
+	}
+	return
+}
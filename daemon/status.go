@@ -0,0 +1,225 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"errors"
+	"time"
+
+	"github.com/rakyll/drivefuse/events"
+	"github.com/rakyll/drivefuse/metadata"
+)
+
+const (
+	maxRecentErrors = 20
+)
+
+var (
+	errNotRunning = errors.New("account is not running")
+	errNotFound   = errors.New("file not found")
+)
+
+// States reported for running accounts, stopped and failed
+// accounts are reported as such.
+const (
+	stateSyncing = "syncing"
+	stateIdle    = "idle"
+	stateOffline = "offline"
+)
+
+var stateNames = []string{"stopped", "running", "failed", "starting"}
+
+// AccountStatus is a snapshot of an account's sync state. State
+// of a running account is syncing, idle or offline, offline if
+// the remote was unreachable at the last sync.
+type AccountStatus struct {
+	Name             string          `json:"name"`
+	LocalPath        string          `json:"local_path"`
+	State            string          `json:"state"`
+	Error            string          `json:"error,omitempty"`
+	Paused           bool            `json:"paused"`
+	LastSync         time.Time       `json:"last_sync"`
+	LargestChangeId  int64           `json:"largest_change_id"`
+	PendingDownloads int64           `json:"pending_downloads"`
+	PendingUploads   int64           `json:"pending_uploads"`
+	PendingChanges   int64           `json:"pending_changes"`
+	CachedFiles      int64           `json:"cached_files"`
+	CachedBytes      int64           `json:"cached_bytes"`
+	RecentErrors     []*ErrorInfo    `json:"recent_errors"`
+	RecentConflicts  []*ConflictInfo `json:"recent_conflicts"`
+}
+
+// ErrorInfo is a sync or download failure.
+type ErrorInfo struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	RemoteId string    `json:"remote_id,omitempty"`
+	Message  string    `json:"message"`
+}
+
+// ConflictInfo is a local change conflicting with a remote one.
+type ConflictInfo struct {
+	Time     time.Time `json:"time"`
+	Name     string    `json:"name"`
+	RemoteId string    `json:"remote_id"`
+}
+
+// Records the sync results published to the account's bus.
+func (a *Account) track(e *events.Event) {
+	switch e.Type {
+	case events.SyncCompleted:
+		a.muStatus.Lock()
+		a.lastSync = e.Time
+		a.muStatus.Unlock()
+	case events.Conflict:
+		a.muStatus.Lock()
+		a.recentConflicts = append(a.recentConflicts, &ConflictInfo{Time: e.Time, Name: e.Name, RemoteId: e.RemoteId})
+		if len(a.recentConflicts) > maxRecentErrors {
+			a.recentConflicts = a.recentConflicts[len(a.recentConflicts)-maxRecentErrors:]
+		}
+		a.muStatus.Unlock()
+	case events.SyncFailed, events.DownloadFailed, events.Offline:
+		info := &ErrorInfo{Time: e.Time, Type: e.Type.String(), RemoteId: e.RemoteId}
+		if e.Err != nil {
+			info.Message = e.Err.Error()
+		}
+		a.muStatus.Lock()
+		a.recentErrors = append(a.recentErrors, info)
+		if len(a.recentErrors) > maxRecentErrors {
+			a.recentErrors = a.recentErrors[len(a.recentErrors)-maxRecentErrors:]
+		}
+		a.muStatus.Unlock()
+	}
+}
+
+// IsStarting tests whether the account is yet to be started or
+// waits for its initial sync, accounts are stopped until started.
+func (s *AccountStatus) IsStarting() bool {
+	return s.State == stateNames[StateStopped] || s.State == stateNames[StateStarting]
+}
+
+// Status gets a snapshot of the account's sync state. Metadata and
+// cache details are only available while the account is running.
+func (a *Account) Status() (status *AccountStatus, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	status = &AccountStatus{
+		Name:      a.Name(),
+		LocalPath: a.Config.LocalPath,
+		State:     stateNames[a.state],
+	}
+	if a.err != nil {
+		status.Error = a.err.Error()
+	}
+	a.muStatus.Lock()
+	status.LastSync = a.lastSync
+	status.RecentErrors = append([]*ErrorInfo{}, a.recentErrors...)
+	status.RecentConflicts = append([]*ConflictInfo{}, a.recentConflicts...)
+	a.muStatus.Unlock()
+	if a.state != StateRunning {
+		return
+	}
+	switch {
+	case a.syncer.IsSyncing():
+		status.State = stateSyncing
+	case a.syncer.IsOffline():
+		status.State = stateOffline
+	default:
+		status.State = stateIdle
+	}
+	status.Paused = a.syncer.IsPaused()
+	if status.LargestChangeId, err = a.metaService.GetLargestChangeId(); err != nil {
+		// not synced yet
+		status.LargestChangeId, err = 0, nil
+	}
+	if status.PendingDownloads, err = a.metaService.CountByOp(metadata.OpDownload); err != nil {
+		return
+	}
+	var fetches int64
+	if fetches, err = a.metaService.CountByOp(metadata.OpFetch); err != nil {
+		return
+	}
+	status.PendingDownloads += fetches
+	if status.PendingUploads, err = a.metaService.CountByOp(metadata.OpUpload); err != nil {
+		return
+	}
+	if status.PendingChanges, err = a.metaService.CountJournal(); err != nil {
+		return
+	}
+	status.CachedFiles, status.CachedBytes, err = a.blobManager.Usage()
+	return
+}
+
+// Queue lists at most limit files queued with op.
+func (a *Account) Queue(op int, limit int64) ([]*metadata.CachedDriveFile, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.state != StateRunning {
+		return nil, errNotRunning
+	}
+	return a.metaService.ListByOp(op, limit)
+}
+
+// Runs a full sync, blocks until it's done.
+func (a *Account) Sync() error {
+	a.mu.Lock()
+	if a.state != StateRunning {
+		a.mu.Unlock()
+		return errNotRunning
+	}
+	s := a.syncer
+	a.mu.Unlock()
+	return s.Sync(true)
+}
+
+// Pauses syncing and downloads.
+func (a *Account) Pause() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.state != StateRunning {
+		return errNotRunning
+	}
+	a.syncer.Pause()
+	return nil
+}
+
+// Resumes syncing and downloads.
+func (a *Account) Resume() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.state != StateRunning {
+		return errNotRunning
+	}
+	a.syncer.Resume()
+	return nil
+}
+
+// Requeues the synced file at the slash separated path p, relative
+// to the mount point, to be downloaded again.
+func (a *Account) Requeue(p string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.state != StateRunning {
+		return errNotRunning
+	}
+	file, err := a.metaService.GetByPath(p)
+	if err != nil {
+		return err
+	}
+	if file == nil || file.IsDir || file.Id == "" || file.LinkTarget != "" {
+		return errNotFound
+	}
+	return a.metaService.SetOp(file.LocalId, metadata.OpFetch)
+}
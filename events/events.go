@@ -0,0 +1,200 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package events provides a bus to publish and subscribe to
+// metadata and sync activity of an account.
+package events
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type Type int
+
+const (
+	FileAdded Type = iota
+	FileChanged
+	FileRemoved
+	DownloadStarted
+	DownloadFinished
+	DownloadFailed
+	Conflict
+	SyncCompleted
+	SyncFailed
+	Offline
+	Online
+	UploadFinished
+)
+
+var typeNames = []string{
+	"file-added",
+	"file-changed",
+	"file-removed",
+	"download-started",
+	"download-finished",
+	"download-failed",
+	"conflict",
+	"sync-completed",
+	"sync-failed",
+	"offline",
+	"online",
+	"upload-finished",
+}
+
+func (t Type) String() string {
+	if int(t) < len(typeNames) {
+		return typeNames[t]
+	}
+	return fmt.Sprintf("event-%d", int(t))
+}
+
+// Event describes an activity of an account. File events carry the
+// location of the file before and after the change, locations are
+// empty for added and removed files respectively.
+type Event struct {
+	Type    Type
+	Account string
+	Time    time.Time
+
+	LocalId           int64
+	RemoteId          string
+	Name              string
+	LocalParentIds    []int64
+	OldName           string
+	OldLocalParentIds []int64
+
+	// Set if the change is originated from the remote.
+	IsRemote bool
+
+	// Error that caused a failure event.
+	Err error
+}
+
+// IsFile tests whether the event is about a file or folder
+// being added, changed or removed.
+func (e *Event) IsFile() bool {
+	return e.Type == FileAdded || e.Type == FileChanged || e.Type == FileRemoved
+}
+
+func (e *Event) String() string {
+	s := fmt.Sprintf("%s %s", e.Account, e.Type)
+	if e.LocalId > 0 {
+		s += fmt.Sprintf(" %d", e.LocalId)
+	}
+	name := e.Name
+	if name == "" {
+		name = e.OldName
+	}
+	if name != "" {
+		s += fmt.Sprintf(" %q", name)
+	}
+	if e.Err != nil {
+		s += ": " + e.Err.Error()
+	}
+	return s
+}
+
+// Bus delivers the published events to its subscribers. A nil
+// bus discards the events.
+type Bus struct {
+	account string
+
+	subscribers map[int]func(*Event)
+	next        int
+
+	mu sync.RWMutex
+}
+
+// Creates a bus for the named account.
+func New(account string) *Bus {
+	return &Bus{account: account, subscribers: make(map[int]func(*Event))}
+}
+
+// Account gets the name of the account the bus belongs to.
+func (b *Bus) Account() string {
+	if b == nil {
+		return ""
+	}
+	return b.account
+}
+
+// Publishes an event, subscribers are called in the publisher's
+// goroutine and shouldn't block.
+func (b *Bus) Publish(e *Event) {
+	if b == nil {
+		return
+	}
+	e.Account = b.account
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.mu.RLock()
+	fns := make([]func(*Event), 0, len(b.subscribers))
+	for _, fn := range b.subscribers {
+		fns = append(fns, fn)
+	}
+	b.mu.RUnlock()
+	for _, fn := range fns {
+		fn(e)
+	}
+}
+
+// Registers fn to be called for each event, returns a function
+// that cancels the subscription.
+func (b *Bus) Subscribe(fn func(*Event)) (cancel func()) {
+	if b == nil {
+		return func() {}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := b.next
+	b.next++
+	b.subscribers[id] = fn
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subscribers, id)
+	}
+}
+
+// Listen delivers the events through a channel buffered with size
+// events, for consumers that might be slow. Events are dropped if the
+// buffer is full. The channel is closed once cancel is called.
+func (b *Bus) Listen(size int) (events <-chan *Event, cancel func()) {
+	ch := make(chan *Event, size)
+	var mu sync.Mutex
+	closed := false
+	unsubscribe := b.Subscribe(func(e *Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		if closed {
+			return
+		}
+		select {
+		case ch <- e:
+		default:
+		}
+	})
+	return ch, func() {
+		unsubscribe()
+		mu.Lock()
+		defer mu.Unlock()
+		if !closed {
+			closed = true
+			close(ch)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"errors"
+	"testing"
+
+	T "github.com/rakyll/drivefuse/third_party/launchpad.net/gocheck"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) {
+	T.TestingT(t)
+}
+
+type EventsSuite struct{}
+
+var _ = T.Suite(&EventsSuite{})
+
+func (s *EventsSuite) TestPublish(c *T.C) {
+	b := New("work")
+	var got []*Event
+	cancel := b.Subscribe(func(e *Event) {
+		got = append(got, e)
+	})
+	b.Publish(&Event{Type: FileAdded, LocalId: 2, Name: "a.txt"})
+	c.Assert(got, T.HasLen, 1)
+	c.Assert(got[0].Account, T.Equals, "work")
+	c.Assert(got[0].Time.IsZero(), T.Equals, false)
+
+	cancel()
+	b.Publish(&Event{Type: FileRemoved})
+	c.Assert(got, T.HasLen, 1)
+}
+
+func (s *EventsSuite) TestNilBus(c *T.C) {
+	var b *Bus
+	c.Assert(b.Account(), T.Equals, "")
+	b.Publish(&Event{Type: FileAdded})
+	b.Subscribe(func(e *Event) {})()
+	events, cancel := b.Listen(1)
+	cancel()
+	_, ok := <-events
+	c.Assert(ok, T.Equals, false)
+}
+
+func (s *EventsSuite) TestListen(c *T.C) {
+	b := New("work")
+	events, cancel := b.Listen(2)
+	for i := int64(1); i <= 3; i++ {
+		b.Publish(&Event{Type: FileChanged, LocalId: i})
+	}
+	// events are dropped once the buffer is full
+	c.Assert((<-events).LocalId, T.Equals, int64(1))
+	c.Assert((<-events).LocalId, T.Equals, int64(2))
+	select {
+	case e := <-events:
+		c.Fatalf("unexpected event %v", e)
+	default:
+	}
+	b.Publish(&Event{Type: FileChanged, LocalId: 4})
+	c.Assert((<-events).LocalId, T.Equals, int64(4))
+
+	cancel()
+	cancel()
+	b.Publish(&Event{Type: FileChanged, LocalId: 5})
+	_, ok := <-events
+	c.Assert(ok, T.Equals, false)
+}
+
+func (s *EventsSuite) TestString(c *T.C) {
+	// every type is named
+	c.Assert(typeNames, T.HasLen, int(UploadFinished)+1)
+	c.Assert(UploadFinished.String(), T.Equals, "upload-finished")
+	c.Assert(Type(100).String(), T.Equals, "event-100")
+	e := &Event{Type: DownloadFailed, Account: "work", LocalId: 3, OldName: "a.txt", Err: errors.New("not found")}
+	c.Assert(e.String(), T.Equals, `work download-failed 3 "a.txt": not found`)
+	c.Assert(e.IsFile(), T.Equals, false)
+	c.Assert((&Event{Type: FileRemoved}).IsFile(), T.Equals, true)
+}
@@ -0,0 +1,157 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package hooks runs the user configured commands on sync events.
+package hooks
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rakyll/drivefuse/config"
+	"github.com/rakyll/drivefuse/events"
+	"github.com/rakyll/drivefuse/logger"
+	"github.com/rakyll/drivefuse/metadata"
+)
+
+const (
+	maxPendingHooks = 256
+)
+
+// Runner runs an account's hooks for the events published to its
+// bus. Hooks are run by a fixed number of workers, hooks are dropped
+// if too many are pending.
+type Runner struct {
+	account     *config.Account
+	metaService *metadata.MetaService
+
+	jobs    chan *job
+	cancel  func()
+	stopped bool
+	wg      sync.WaitGroup
+
+	mu sync.Mutex
+}
+
+type job struct {
+	hook     *config.Hook
+	event    string
+	path     string
+	remoteId string
+}
+
+// Starts running the account's hooks for the events published to bus,
+// at most concurrency hooks are run at once.
+func Start(account *config.Account, metaService *metadata.MetaService, bus *events.Bus, concurrency int) *Runner {
+	r := &Runner{
+		account:     account,
+		metaService: metaService,
+		jobs:        make(chan *job, maxPendingHooks),
+	}
+	if len(account.Hooks) == 0 {
+		return r
+	}
+	for i := 0; i < concurrency; i++ {
+		r.wg.Add(1)
+		go r.work()
+	}
+	r.cancel = bus.Subscribe(r.handle)
+	return r
+}
+
+// Stops handling events, waits for the pending and running
+// hooks to exit.
+func (r *Runner) Stop() {
+	if r.cancel == nil {
+		return
+	}
+	r.cancel()
+	r.mu.Lock()
+	// events might be in flight while unsubscribing
+	r.stopped = true
+	close(r.jobs)
+	r.mu.Unlock()
+	r.wg.Wait()
+}
+
+func (r *Runner) handle(e *events.Event) {
+	var event string
+	switch {
+	case e.Type == events.DownloadFinished:
+		event = config.HookDownloaded
+	case e.Type == events.UploadFinished:
+		event = config.HookUploaded
+	case e.Type == events.FileRemoved && e.IsRemote:
+		event = config.HookDeleted
+	case e.Type == events.Conflict:
+		event = config.HookConflict
+	default:
+		return
+	}
+	p, err := r.metaService.GetPath(e.LocalId)
+	if err != nil {
+		logger.V("error resolving path for hooks", e.LocalId, err)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopped {
+		return
+	}
+	for i := range r.account.Hooks {
+		hook := &r.account.Hooks[i]
+		if !hook.Match(event, p) {
+			continue
+		}
+		select {
+		case r.jobs <- &job{hook: hook, event: event, path: p, remoteId: e.RemoteId}:
+		default:
+			logger.V("too many pending hooks, skipping", hook.Command[0], p)
+		}
+	}
+}
+
+func (r *Runner) work() {
+	defer r.wg.Done()
+	for j := range r.jobs {
+		if err := r.run(j); err != nil {
+			logger.V("hook failed", j.hook.Command[0], j.path, err)
+		}
+	}
+}
+
+// Runs the hook's command, kills it if it times out.
+func (r *Runner) run(j *job) error {
+	localPath := filepath.Join(r.account.LocalPath, filepath.FromSlash(j.path))
+	args := append(append([]string{}, j.hook.Command[1:]...), localPath, j.remoteId)
+	cmd := exec.Command(j.hook.Command[0], args...)
+	cmd.Env = append(os.Environ(),
+		"DRIVEFUSE_ACCOUNT="+r.account.Name,
+		"DRIVEFUSE_EVENT="+j.event,
+		"DRIVEFUSE_PATH="+localPath,
+		"DRIVEFUSE_ID="+j.remoteId)
+	logger.D("Running hook", j.hook.Command[0], j.event, localPath)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	timer := time.AfterFunc(j.hook.TimeoutDuration(), func() {
+		logger.V("hook timed out", j.hook.Command[0], localPath)
+		cmd.Process.Kill()
+	})
+	defer timer.Stop()
+	return cmd.Wait()
+}
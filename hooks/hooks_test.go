@@ -0,0 +1,136 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hooks
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rakyll/drivefuse/config"
+	"github.com/rakyll/drivefuse/events"
+	"github.com/rakyll/drivefuse/metadata"
+	T "github.com/rakyll/drivefuse/third_party/launchpad.net/gocheck"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) {
+	T.TestingT(t)
+}
+
+// Appends the event, the arguments and the environment of the
+// hook to the file at out.
+const script = `echo "$DRIVEFUSE_ACCOUNT $DRIVEFUSE_EVENT $DRIVEFUSE_PATH $DRIVEFUSE_ID $1 $2" >> "$OUT"`
+
+type HooksSuite struct {
+	dir string
+	out string
+}
+
+var _ = T.Suite(&HooksSuite{})
+
+func (s *HooksSuite) SetUpTest(c *T.C) {
+	s.dir = c.MkDir()
+	s.out = filepath.Join(s.dir, "out")
+	os.Setenv("OUT", s.out)
+}
+
+func (s *HooksSuite) TearDownTest(c *T.C) {
+	os.Unsetenv("OUT")
+}
+
+func (s *HooksSuite) runner(hooks ...config.Hook) *Runner {
+	return &Runner{account: &config.Account{Name: "work", LocalPath: "/mnt/drive", Hooks: hooks}}
+}
+
+func (s *HooksSuite) output(c *T.C) string {
+	data, err := ioutil.ReadFile(s.out)
+	if os.IsNotExist(err) {
+		return ""
+	}
+	c.Assert(err, T.IsNil)
+	return string(data)
+}
+
+func (s *HooksSuite) TestRun(c *T.C) {
+	hook := config.Hook{Events: []string{config.HookDownloaded}, Command: []string{"sh", "-c", script, "hook"}}
+	r := s.runner(hook)
+	err := r.run(&job{hook: &hook, event: config.HookDownloaded, path: "docs/a.txt", remoteId: "id"})
+	c.Assert(err, T.IsNil)
+	c.Assert(s.output(c), T.Equals, "work downloaded /mnt/drive/docs/a.txt id /mnt/drive/docs/a.txt id\n")
+}
+
+func (s *HooksSuite) TestRunFailed(c *T.C) {
+	hook := config.Hook{Events: []string{config.HookDownloaded}, Command: []string{"sh", "-c", "exit 3"}}
+	err := s.runner(hook).run(&job{hook: &hook, event: config.HookDownloaded, path: "a.txt"})
+	c.Assert(err, T.ErrorMatches, "exit status 3")
+
+	hook.Command = []string{filepath.Join(s.dir, "missing")}
+	err = s.runner(hook).run(&job{hook: &hook, event: config.HookDownloaded, path: "a.txt"})
+	c.Assert(err, T.NotNil)
+}
+
+func (s *HooksSuite) TestRunTimeout(c *T.C) {
+	hook := config.Hook{Events: []string{config.HookDownloaded}, Command: []string{"sh", "-c", "exec sleep 30"}, Timeout: 1}
+	start := time.Now()
+	err := s.runner(hook).run(&job{hook: &hook, event: config.HookDownloaded, path: "a.txt"})
+	c.Assert(err, T.NotNil)
+	c.Assert(time.Since(start) < 10*time.Second, T.Equals, true)
+}
+
+func (s *HooksSuite) TestEvents(c *T.C) {
+	m, err := metadata.New(filepath.Join(s.dir, "meta.sql"), nil)
+	c.Assert(err, T.IsNil)
+	defer m.Close()
+	c.Assert(m.RemoteMod(metadata.IdRoot, nil, &metadata.CachedDriveFile{IsDir: true}), T.IsNil)
+	c.Assert(m.RemoteMod("docs", []string{metadata.IdRoot}, &metadata.CachedDriveFile{Name: "docs", IsDir: true}), T.IsNil)
+	c.Assert(m.RemoteMod("a", []string{"docs"}, &metadata.CachedDriveFile{Name: "a.txt"}), T.IsNil)
+	c.Assert(m.RemoteMod("b", []string{metadata.IdRoot}, &metadata.CachedDriveFile{Name: "b.txt"}), T.IsNil)
+	a, err := m.GetByRemoteId("a")
+	c.Assert(err, T.IsNil)
+	b, err := m.GetByRemoteId("b")
+	c.Assert(err, T.IsNil)
+
+	account := &config.Account{Name: "work", LocalPath: "/mnt/drive", Hooks: []config.Hook{
+		{Path: "docs", Events: []string{config.HookDownloaded, config.HookDeleted}, Command: []string{"sh", "-c", script, "hook"}},
+	}}
+	bus := events.New("work")
+	r := Start(account, m, bus, 1)
+	bus.Publish(&events.Event{Type: events.DownloadFinished, LocalId: a.LocalId, RemoteId: "a"})
+	// not matching the path
+	bus.Publish(&events.Event{Type: events.DownloadFinished, LocalId: b.LocalId, RemoteId: "b"})
+	// not matching the events
+	bus.Publish(&events.Event{Type: events.UploadFinished, LocalId: a.LocalId, RemoteId: "a"})
+	// removed locally, not a deletion from the remote
+	bus.Publish(&events.Event{Type: events.FileRemoved, LocalId: a.LocalId, RemoteId: "a"})
+	bus.Publish(&events.Event{Type: events.FileRemoved, LocalId: a.LocalId, RemoteId: "a", IsRemote: true})
+	r.Stop()
+	expected := "work downloaded /mnt/drive/docs/a.txt a /mnt/drive/docs/a.txt a\n" +
+		"work deleted /mnt/drive/docs/a.txt a /mnt/drive/docs/a.txt a\n"
+	c.Assert(s.output(c), T.Equals, expected)
+
+	// stopped runners ignore the events
+	bus.Publish(&events.Event{Type: events.DownloadFinished, LocalId: a.LocalId, RemoteId: "a"})
+	c.Assert(s.output(c), T.Equals, expected)
+}
+
+func (s *HooksSuite) TestNoHooks(c *T.C) {
+	bus := events.New("work")
+	r := Start(&config.Account{Name: "work"}, nil, bus, 1)
+	bus.Publish(&events.Event{Type: events.DownloadFinished, LocalId: 1})
+	r.Stop()
+}
@@ -0,0 +1,224 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import (
+	"time"
+
+	"github.com/rakyll/drivefuse/logger"
+	"github.com/rakyll/drivefuse/third_party/github.com/coopernurse/gorp"
+)
+
+// Kinds of the journaled local changes.
+const (
+	JournalCreate = iota + 1
+	JournalRename // renames and moves
+	JournalRemove
+	JournalModify // contents are written
+	JournalLink   // a parent is added
+	JournalUnlink // a parent is removed
+)
+
+// JournalEntry is a local change to be propagated to the remote.
+// Entries are appended in the order the changes are made and
+// replayed in the same order.
+type JournalEntry struct {
+	Seq     int64
+	LocalId int64
+	Kind    int
+	IsDir   bool
+	IsLocal bool // local-only, never uploaded
+
+	// location before the change, empty for created files, the
+	// removed parent for unlinked files
+	OldLocalParentId int64
+	OldName          string
+
+	// location after the change, empty for removed files, the
+	// location at the time of writing for modified files, the
+	// added parent for linked files
+	LocalParentId int64
+	Name          string
+
+	Time time.Time
+}
+
+// Lists at most limit journal entries in the order they
+// are appended.
+func (m *MetaService) ListJournal(limit int64) (entries []*JournalEntry, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, err = m.dbmap.Select(&entries, "select * from journal order by seq limit ?", limit)
+	return
+}
+
+// Counts the journal entries yet to be replayed.
+func (m *MetaService) CountJournal() (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.dbmap.SelectInt("select count(*) from journal")
+}
+
+// Counts the journal entries of a file that upload its contents
+// once they are replayed.
+func (m *MetaService) CountUploads(localId int64) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.dbmap.SelectInt("select count(*) from journal where localid = ? and kind in (?, ?)", localId, JournalCreate, JournalModify)
+}
+
+// Removes a replayed journal entry. The file is no longer queued
+// for upload once it has no other entries, removed files are
+// dropped from the metadata.
+func (m *MetaService) CompleteJournalEntry(e *JournalEntry) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err = m.dbmap.Exec("delete from journal where seq = ?", e.Seq); err != nil {
+		return
+	}
+	var n int64
+	if n, err = m.dbmap.SelectInt("select count(*) from journal where localid = ?", e.LocalId); err != nil || n > 0 {
+		return
+	}
+	var file *CachedDriveFile
+	if file, err = getByLocalId(m.dbmap, e.LocalId); err != nil || file == nil {
+		return
+	}
+	switch file.Op {
+	case OpDelete:
+		return purge(m.dbmap, file.LocalId)
+	case OpUpload:
+		return setOp(m.dbmap, file.LocalId, OpNone)
+	}
+	return
+}
+
+// Compacts the journal by merging the successive changes of
+// the same file, e.g. a file created, renamed and removed is
+// never propagated. Gets the number of entries dropped.
+func (m *MetaService) CompactJournal() (dropped int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var entries []*JournalEntry
+	if _, err = m.dbmap.Select(&entries, "select * from journal order by seq"); err != nil {
+		return
+	}
+	kept, changed := compactJournal(entries)
+	if len(kept) == len(entries) && len(changed) == 0 {
+		return
+	}
+	var tx *gorp.Transaction
+	if tx, err = m.dbmap.Begin(); err != nil {
+		return
+	}
+	isKept := make(map[int64]bool, len(kept))
+	for _, e := range kept {
+		isKept[e.Seq] = true
+	}
+	for _, e := range entries {
+		if !isKept[e.Seq] {
+			_, err = tx.Exec("delete from journal where seq = ?", e.Seq)
+		} else if changed[e.Seq] {
+			_, err = tx.Update(e)
+		}
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+	}
+	// local-only files removed before they are uploaded
+	if _, err = tx.Exec("delete from parents where localid in (select localid from files where id = '' and op = ? and localid not in (select localid from journal))", OpDelete); err == nil {
+		_, err = tx.Exec("delete from files where id = '' and op = ? and localid not in (select localid from journal)", OpDelete)
+	}
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	return len(entries) - len(kept), nil
+}
+
+// Merges each entry into the preceding one if both are changes
+// of the same file. Merged entries take the location the file
+// ends up at. Gets the entries kept and the ones modified.
+func compactJournal(entries []*JournalEntry) (kept []*JournalEntry, changed map[int64]bool) {
+	changed = make(map[int64]bool)
+	for _, e := range entries {
+		if e.Kind == JournalRemove {
+			// contents and parents of removed files are not uploaded
+			for len(kept) > 0 && kept[len(kept)-1].LocalId == e.LocalId && isDropped(kept[len(kept)-1].Kind) {
+				kept = kept[:len(kept)-1]
+			}
+		}
+		if len(kept) == 0 || kept[len(kept)-1].LocalId != e.LocalId {
+			kept = append(kept, e)
+			continue
+		}
+		last := kept[len(kept)-1]
+		switch {
+		case e.Kind == JournalModify && last.Kind == JournalModify:
+			// contents are uploaded as they are once replayed
+		case e.Kind == JournalRename && (last.Kind == JournalCreate || last.Kind == JournalRename):
+			// created or renamed, take the latest location
+			last.LocalParentId, last.Name = e.LocalParentId, e.Name
+			last.IsLocal, last.Time = e.IsLocal, e.Time
+			changed[last.Seq] = true
+			if last.Kind == JournalRename && last.LocalParentId == last.OldLocalParentId && last.Name == last.OldName {
+				// renamed back
+				kept = kept[:len(kept)-1]
+			}
+		case e.Kind == JournalRemove && last.Kind == JournalCreate:
+			// never existed on the remote
+			kept = kept[:len(kept)-1]
+		case e.Kind == JournalRemove && last.Kind == JournalRename:
+			// trashing doesn't depend on the location
+			e.OldLocalParentId, e.OldName = last.OldLocalParentId, last.OldName
+			changed[e.Seq] = true
+			kept[len(kept)-1] = e
+		default:
+			kept = append(kept, e)
+		}
+	}
+	return
+}
+
+// Tells whether entries of kind are dropped if the file is removed
+// afterwards.
+func isDropped(kind int) bool {
+	return kind == JournalModify || kind == JournalLink || kind == JournalUnlink
+}
+
+// Drops a removed file from the metadata once the removal is
+// propagated.
+func purge(exec gorp.SqlExecutor, localId int64) (err error) {
+	logger.V("Purging metadata for", localId)
+	if _, err = exec.Exec("delete from parents where localid = ? or localparentid = ?", localId, localId); err != nil {
+		return
+	}
+	_, err = exec.Exec("delete from files where localid = ?", localId)
+	return
+}
+
+func hasJournal(exec gorp.SqlExecutor, localId int64) (bool, error) {
+	n, err := exec.SelectInt("select count(*) from journal where localid = ?", localId)
+	return n > 0, err
+}
+
+func appendJournal(exec gorp.SqlExecutor, e *JournalEntry) error {
+	e.Time = time.Now()
+	return exec.Insert(e)
+}
@@ -0,0 +1,260 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import (
+	"path/filepath"
+
+	T "github.com/rakyll/drivefuse/third_party/launchpad.net/gocheck"
+)
+
+type JournalSuite struct{}
+
+var _ = T.Suite(&JournalSuite{})
+
+func create(seq, localId, parentId int64, name string) *JournalEntry {
+	return &JournalEntry{Seq: seq, LocalId: localId, Kind: JournalCreate, LocalParentId: parentId, Name: name}
+}
+
+func rename(seq, localId, oldParentId int64, oldName string, parentId int64, name string) *JournalEntry {
+	return &JournalEntry{Seq: seq, LocalId: localId, Kind: JournalRename,
+		OldLocalParentId: oldParentId, OldName: oldName, LocalParentId: parentId, Name: name}
+}
+
+func modify(seq, localId, parentId int64, name string) *JournalEntry {
+	return &JournalEntry{Seq: seq, LocalId: localId, Kind: JournalModify, LocalParentId: parentId, Name: name}
+}
+
+func remove(seq, localId, oldParentId int64, oldName string) *JournalEntry {
+	return &JournalEntry{Seq: seq, LocalId: localId, Kind: JournalRemove, OldLocalParentId: oldParentId, OldName: oldName}
+}
+
+func link(seq, localId, parentId int64) *JournalEntry {
+	return &JournalEntry{Seq: seq, LocalId: localId, Kind: JournalLink, LocalParentId: parentId}
+}
+
+func unlink(seq, localId, oldParentId int64) *JournalEntry {
+	return &JournalEntry{Seq: seq, LocalId: localId, Kind: JournalUnlink, OldLocalParentId: oldParentId}
+}
+
+var compactJournalTests = []struct {
+	name    string
+	entries []*JournalEntry
+	kept    []*JournalEntry
+	changed []int64
+}{
+	{
+		name:    "empty",
+		entries: nil,
+		kept:    nil,
+	},
+	{
+		name:    "single create",
+		entries: []*JournalEntry{create(1, 10, 1, "a")},
+		kept:    []*JournalEntry{create(1, 10, 1, "a")},
+	},
+	{
+		name:    "create then rename",
+		entries: []*JournalEntry{create(1, 10, 1, "a"), rename(2, 10, 1, "a", 2, "b")},
+		kept:    []*JournalEntry{create(1, 10, 2, "b")},
+		changed: []int64{1},
+	},
+	{
+		name:    "renamed twice",
+		entries: []*JournalEntry{rename(1, 10, 1, "a", 1, "b"), rename(2, 10, 1, "b", 2, "c")},
+		kept:    []*JournalEntry{rename(1, 10, 1, "a", 2, "c")},
+		changed: []int64{1},
+	},
+	{
+		name:    "renamed back",
+		entries: []*JournalEntry{rename(1, 10, 1, "a", 1, "b"), rename(2, 10, 1, "b", 1, "a")},
+		kept:    nil,
+		changed: []int64{1},
+	},
+	{
+		name:    "create then remove",
+		entries: []*JournalEntry{create(1, 10, 1, "a"), rename(2, 10, 1, "a", 1, "b"), remove(3, 10, 1, "b")},
+		kept:    nil,
+		changed: []int64{1},
+	},
+	{
+		name:    "rename then remove",
+		entries: []*JournalEntry{rename(1, 10, 1, "a", 1, "b"), remove(2, 10, 1, "b")},
+		kept:    []*JournalEntry{remove(2, 10, 1, "a")},
+		changed: []int64{2},
+	},
+	{
+		name:    "remove then create",
+		entries: []*JournalEntry{remove(1, 10, 1, "a"), create(2, 10, 1, "a")},
+		kept:    []*JournalEntry{remove(1, 10, 1, "a"), create(2, 10, 1, "a")},
+	},
+	{
+		name:    "interleaved files",
+		entries: []*JournalEntry{create(1, 10, 1, "a"), create(2, 11, 1, "b"), rename(3, 10, 1, "a", 1, "c")},
+		kept:    []*JournalEntry{create(1, 10, 1, "a"), create(2, 11, 1, "b"), rename(3, 10, 1, "a", 1, "c")},
+	},
+	{
+		name:    "create folder and child",
+		entries: []*JournalEntry{create(1, 10, 1, "dir"), create(2, 11, 10, "a"), remove(3, 11, 10, "a"), rename(4, 10, 1, "dir", 1, "renamed")},
+		kept:    []*JournalEntry{create(1, 10, 1, "renamed")},
+		changed: []int64{1},
+	},
+	{
+		name:    "written twice",
+		entries: []*JournalEntry{modify(1, 10, 1, "a"), modify(2, 10, 1, "a")},
+		kept:    []*JournalEntry{modify(1, 10, 1, "a")},
+	},
+	{
+		name:    "written then renamed",
+		entries: []*JournalEntry{modify(1, 10, 1, "a"), rename(2, 10, 1, "a", 1, "b")},
+		kept:    []*JournalEntry{modify(1, 10, 1, "a"), rename(2, 10, 1, "a", 1, "b")},
+	},
+	{
+		name:    "written then removed",
+		entries: []*JournalEntry{modify(1, 10, 1, "a"), modify(2, 10, 1, "a"), remove(3, 10, 1, "a")},
+		kept:    []*JournalEntry{remove(3, 10, 1, "a")},
+	},
+	{
+		name:    "created, written and removed",
+		entries: []*JournalEntry{create(1, 10, 1, "a"), modify(2, 10, 1, "a"), remove(3, 10, 1, "a")},
+		kept:    nil,
+	},
+	{
+		name:    "linked then unlinked",
+		entries: []*JournalEntry{link(1, 10, 2), unlink(2, 10, 1)},
+		kept:    []*JournalEntry{link(1, 10, 2), unlink(2, 10, 1)},
+	},
+	{
+		name:    "linked then removed",
+		entries: []*JournalEntry{link(1, 10, 2), modify(2, 10, 1, "a"), unlink(3, 10, 1), remove(4, 10, 2, "a")},
+		kept:    []*JournalEntry{remove(4, 10, 2, "a")},
+	},
+	{
+		name:    "created, linked and removed",
+		entries: []*JournalEntry{create(1, 10, 1, "a"), link(2, 10, 2), remove(3, 10, 1, "a")},
+		kept:    nil,
+	},
+}
+
+func (s *JournalSuite) TestCompactJournal(c *T.C) {
+	for _, test := range compactJournalTests {
+		kept, changed := compactJournal(test.entries)
+		c.Assert(kept, T.HasLen, len(test.kept), T.Commentf(test.name))
+		for i, e := range test.kept {
+			c.Assert(*kept[i], T.DeepEquals, *e, T.Commentf(test.name))
+		}
+		c.Assert(changed, T.HasLen, len(test.changed), T.Commentf(test.name))
+		for _, seq := range test.changed {
+			c.Assert(changed[seq], T.Equals, true, T.Commentf(test.name))
+		}
+	}
+}
+
+func (s *JournalSuite) TestRemovedFilesArePurged(c *T.C) {
+	m, err := New(filepath.Join(c.MkDir(), "meta.sql"), nil)
+	c.Assert(err, T.IsNil)
+	defer m.Close()
+	c.Assert(m.RemoteMod(IdRoot, nil, &CachedDriveFile{IsDir: true}), T.IsNil)
+	root, err := m.GetByRemoteId(IdRoot)
+	c.Assert(err, T.IsNil)
+
+	// uploaded, purged once the removal is replayed
+	c.Assert(m.RemoteMod("synced", []string{IdRoot}, &CachedDriveFile{Name: "synced"}), T.IsNil)
+	c.Assert(m.LocalRm(root.LocalId, "synced", false), T.IsNil)
+	entries, err := m.ListJournal(10)
+	c.Assert(err, T.IsNil)
+	c.Assert(entries, T.HasLen, 1)
+	c.Assert(m.CompleteJournalEntry(entries[0]), T.IsNil)
+	file, err := m.GetByRemoteId("synced")
+	c.Assert(err, T.IsNil)
+	c.Assert(file, T.IsNil)
+
+	// never uploaded, purged once compacted
+	_, err = m.LocalCreate(root.LocalId, "local", 0, false, false)
+	c.Assert(err, T.IsNil)
+	c.Assert(m.LocalRm(root.LocalId, "local", false), T.IsNil)
+	dropped, err := m.CompactJournal()
+	c.Assert(err, T.IsNil)
+	c.Assert(dropped, T.Equals, 2)
+	n, err := m.dbmap.SelectInt("select count(*) from files where op = ?", OpDelete)
+	c.Assert(err, T.IsNil)
+	c.Assert(n, T.Equals, int64(0))
+}
+
+func (s *JournalSuite) TestPendingUploadsAreKept(c *T.C) {
+	m, err := New(filepath.Join(c.MkDir(), "meta.sql"), nil)
+	c.Assert(err, T.IsNil)
+	defer m.Close()
+	c.Assert(m.RemoteMod(IdRoot, nil, &CachedDriveFile{IsDir: true}), T.IsNil)
+	c.Assert(m.RemoteMod("file", []string{IdRoot}, &CachedDriveFile{Name: "file", Md5Checksum: "v1"}), T.IsNil)
+	file, err := m.GetByRemoteId("file")
+	c.Assert(err, T.IsNil)
+	c.Assert(m.LocalWrite(file.LocalId, 3), T.IsNil)
+
+	// changed on the remote while the written contents are queued
+	c.Assert(m.RemoteMod("file", []string{IdRoot}, &CachedDriveFile{Name: "file", Md5Checksum: "v2"}), T.IsNil)
+	file, err = m.GetByRemoteId("file")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.Op, T.Equals, OpUpload)
+	n, err := m.CountUploads(file.LocalId)
+	c.Assert(err, T.IsNil)
+	c.Assert(n, T.Equals, int64(1))
+
+	// downloaded once the contents are uploaded
+	entries, err := m.ListJournal(10)
+	c.Assert(err, T.IsNil)
+	c.Assert(entries, T.HasLen, 1)
+	c.Assert(m.CompleteJournalEntry(entries[0]), T.IsNil)
+	c.Assert(m.RemoteMod("file", []string{IdRoot}, &CachedDriveFile{Name: "file", Md5Checksum: "v3"}), T.IsNil)
+	file, err = m.GetByRemoteId("file")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.Op, T.Equals, OpDownload)
+}
+
+func (s *JournalSuite) TestLinksAreJournaled(c *T.C) {
+	m, err := New(filepath.Join(c.MkDir(), "meta.sql"), nil)
+	c.Assert(err, T.IsNil)
+	defer m.Close()
+	c.Assert(m.RemoteMod(IdRoot, nil, &CachedDriveFile{IsDir: true}), T.IsNil)
+	c.Assert(m.RemoteMod("folder", []string{IdRoot}, &CachedDriveFile{Name: "folder", IsDir: true}), T.IsNil)
+	root, err := m.GetByRemoteId(IdRoot)
+	c.Assert(err, T.IsNil)
+	folder, err := m.GetByRemoteId("folder")
+	c.Assert(err, T.IsNil)
+
+	link, err := m.LocalSymlink(root.LocalId, "link", "target", false)
+	c.Assert(err, T.IsNil)
+	c.Assert(link.LinkTarget, T.Equals, "target")
+	c.Assert(link.MimeType, T.Equals, MimeTypeSymlink)
+	c.Assert(link.FileSize, T.Equals, int64(6))
+	c.Assert(m.LocalLink(link.LocalId, folder.LocalId), T.IsNil)
+	// already a parent, nothing to propagate
+	c.Assert(m.LocalLink(link.LocalId, folder.LocalId), T.IsNil)
+	c.Assert(m.LocalUnlink(link.LocalId, root.LocalId), T.IsNil)
+	// last parent is kept
+	c.Assert(m.LocalUnlink(link.LocalId, folder.LocalId), T.IsNil)
+
+	parentIds, err := m.GetParentIds(link.LocalId)
+	c.Assert(err, T.IsNil)
+	c.Assert(parentIds, T.DeepEquals, []int64{folder.LocalId})
+	entries, err := m.ListJournal(10)
+	c.Assert(err, T.IsNil)
+	c.Assert(entries, T.HasLen, 3)
+	c.Assert(entries[0].Kind, T.Equals, JournalCreate)
+	c.Assert(entries[1].Kind, T.Equals, JournalLink)
+	c.Assert(entries[1].LocalParentId, T.Equals, folder.LocalId)
+	c.Assert(entries[2].Kind, T.Equals, JournalUnlink)
+	c.Assert(entries[2].OldLocalParentId, T.Equals, root.LocalId)
+}
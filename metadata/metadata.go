@@ -17,10 +17,13 @@ package metadata
 import (
 	"database/sql"
 	"fmt"
+	"path"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/rakyll/drivefuse/events"
 	"github.com/rakyll/drivefuse/logger"
 	"github.com/rakyll/drivefuse/third_party/github.com/coopernurse/gorp"
 	_ "github.com/rakyll/drivefuse/third_party/github.com/mattn/go-sqlite3"
@@ -31,14 +34,25 @@ const (
 	OpDownload
 	OpUpload
 	OpDelete
+	OpLocal // local-only, never uploaded
+	OpFetch // downloaded on demand, regardless of the rules
 
-	MimeTypeFolder = "application/vnd.google-apps.folder"
-	IdRoot         = "root"
+	MimeTypeFolder  = "application/vnd.google-apps.folder"
+	MimeTypeSymlink = "text/plain"
+	IdRoot          = "root"
+
+	// Public Drive property that marks a file as a symlink,
+	// value of the property is the target path.
+	PropertySymlinkTarget = "drivefuse.symlink"
 
 	keyLargestChangeId = "largest-change-id"
+
+	maxPathDepth = 64
 )
 
 // CachedDriveFile represents metadata about a Drive file or folder.
+// A file might have multiple parents, LocalParentId is the first
+// one, all parents are listed in the parents table.
 // TODO(burcud): Rename it to FileEntry
 type CachedDriveFile struct {
 	LocalId       int64
@@ -50,10 +64,34 @@ type CachedDriveFile struct {
 	LastEtag      string
 	FileSize      int64
 	IsDir         bool
+	LinkTarget    string
+	MimeType      string
 
 	Op int
 }
 
+// Change describes a modification of a cached file or folder, it's
+// published as an event. Old location is empty if the file is newly
+// created. IsRemote is set if the change is originated from the
+// remote, IsConflict if the remote change conflicts with a local
+// one. Local changes yet to be uploaded are kept.
+type Change struct {
+	LocalId           int64
+	RemoteId          string
+	LocalParentIds    []int64
+	Name              string
+	OldLocalParentIds []int64
+	OldName           string
+	IsRemote          bool
+	IsConflict        bool
+}
+
+// ParentEntry links a file or folder to one of its parents.
+type ParentEntry struct {
+	LocalId       int64
+	LocalParentId int64
+}
+
 type KeyValueEntry struct {
 	Key   string
 	Value string
@@ -62,191 +100,402 @@ type KeyValueEntry struct {
 // MetaService implements utility methods to retrieve, save, delete
 // metadata about Google Drive files/folders.
 type MetaService struct {
-	dbmap *gorp.DbMap
+	dbmap   *gorp.DbMap
+	dbPath  string
+	queries *queries
+	bus     *events.Bus
 
 	mu sync.RWMutex // TODO(burcud): Lock for each file ID indiviually
 }
 
-// Initiates a new MetaService.
-func New(dbPath string) (metaservice *MetaService, err error) {
+// Initiates a new MetaService, changes are published to bus.
+func New(dbPath string, bus *events.Bus) (metaservice *MetaService, err error) {
 	var dbase *sql.DB
 	if dbase, err = sql.Open("sqlite3", dbPath); err != nil {
 		return
 	}
-	metaservice = &MetaService{dbmap: &gorp.DbMap{Db: dbase, Dialect: &gorp.SqliteDialect{}}}
+	metaservice = &MetaService{dbmap: &gorp.DbMap{Db: dbase, Dialect: &gorp.SqliteDialect{}}, dbPath: dbPath, bus: bus}
 	if err = metaservice.setup(); err != nil {
-		return
+		dbase.Close()
+		return nil, err
+	}
+	if metaservice.queries, err = prepareQueries(dbase); err != nil {
+		dbase.Close()
+		return nil, err
 	}
 	return metaservice, nil
 }
 
-// Permanently saves a file/folder's metadata.
-func (m *MetaService) RemoteMod(remoteId string, newParentRemoteId string, data *CachedDriveFile) (err error) {
+// Permanently saves a file/folder's metadata. Parents that are
+// not cached are ignored.
+func (m *MetaService) RemoteMod(remoteId string, parentRemoteIds []string, data *CachedDriveFile) (err error) {
+	change := &Change{IsRemote: true}
+	defer m.notify(change)
 	m.mu.Lock()
 	defer m.mu.Unlock()
-
-	logger.V("Caching metadata for", remoteId)
-	var parentFile *CachedDriveFile
-	if newParentRemoteId != "" {
-		if parentFile, err = m.getByRemoteId(newParentRemoteId); err != nil {
-			return err
-		}
-	}
-
-	var file *CachedDriveFile
-	if file, err = m.getByRemoteId(remoteId); err != nil {
-		return err
-	}
-	if file == nil {
-		file = &CachedDriveFile{Id: remoteId}
-	}
-	if data.Md5Checksum != file.Md5Checksum && !data.IsDir {
-		file.Op = OpDownload
-	}
-	file.Id = remoteId
-
-	file.Name = data.Name
-	file.LastMod = data.LastMod
-	file.Md5Checksum = data.Md5Checksum
-	file.LastEtag = data.LastEtag
-	file.FileSize = data.FileSize
-	file.IsDir = data.IsDir
-	file.LocalParentId = 0
-	if parentFile != nil {
-		file.LocalParentId = parentFile.LocalId
-	}
-	if file.LocalId > 0 {
-		_, err = m.dbmap.Update(file)
-		return
-	}
-	return m.dbmap.Insert(file)
+	return remoteMod(m.dbmap, change, remoteId, parentRemoteIds, data)
 }
 
 func (m *MetaService) RemoteRm(remoteId string) (err error) {
+	change := &Change{IsRemote: true}
+	defer m.notify(change)
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	// TODO: Handle directories recursively
-	logger.V("Deleting metadata for", remoteId)
-	var file *CachedDriveFile
-	if file, err = m.getByRemoteId(remoteId); err != nil {
-		return err
-	}
-	if file == nil {
-		return
-	}
-	file.Op = OpDelete
-	_, err = m.dbmap.Update(file)
-	return err
+	return remoteRm(m.dbmap, change, remoteId)
 }
 
-func (m *MetaService) LocalCreate(localParentId int64, name string, filesize int64, isDir bool) (*CachedDriveFile, error) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	file := &CachedDriveFile{
+// Caches a locally created file or folder, queues it for upload
+// unless isLocal is set.
+func (m *MetaService) LocalCreate(localParentId int64, name string, filesize int64, isDir bool, isLocal bool) (*CachedDriveFile, error) {
+	return m.localCreate(&CachedDriveFile{
 		LocalParentId: localParentId,
 		Name:          name,
-		LastMod:       time.Now(),
 		FileSize:      filesize,
 		IsDir:         isDir,
-		Op:            OpUpload,
+	}, isLocal)
+}
+
+// Caches a locally created symlink to target, queues it for upload
+// unless isLocal is set.
+func (m *MetaService) LocalSymlink(localParentId int64, name string, target string, isLocal bool) (*CachedDriveFile, error) {
+	return m.localCreate(&CachedDriveFile{
+		LocalParentId: localParentId,
+		Name:          name,
+		FileSize:      int64(len(target)),
+		LinkTarget:    target,
+		MimeType:      MimeTypeSymlink,
+	}, isLocal)
+}
+
+func (m *MetaService) localCreate(file *CachedDriveFile, isLocal bool) (*CachedDriveFile, error) {
+	change := &Change{}
+	defer m.notify(change)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	file.LastMod = time.Now()
+	file.Op = OpUpload
+	if isLocal {
+		file.Op = OpLocal
+	}
+	if err := m.dbmap.Insert(file); err != nil {
+		return file, err
+	}
+	parentIds := []int64{file.LocalParentId}
+	if err := setParentIds(m.dbmap, file.LocalId, parentIds); err != nil {
+		return file, err
+	}
+	err := appendJournal(m.dbmap, &JournalEntry{
+		LocalId:       file.LocalId,
+		Kind:          JournalCreate,
+		IsDir:         file.IsDir,
+		IsLocal:       isLocal,
+		LocalParentId: file.LocalParentId,
+		Name:          file.Name,
+	})
+	if err == nil {
+		change.set(file, parentIds)
 	}
-	err := m.dbmap.Insert(file)
 	return file, err
 }
 
-func (m *MetaService) LocalMod(localParentId int64, name string, newParentId int64, newName string, newFileSize int64) (err error) {
+// Renames the file or moves it from localParentId to newParentId,
+// other parents of the file are kept. The file is queued for upload
+// unless isLocal is set.
+func (m *MetaService) LocalMod(localParentId int64, name string, newParentId int64, newName string, newFileSize int64, isLocal bool) (err error) {
+	change := &Change{OldName: name}
+	defer m.notify(change)
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	var files []*CachedDriveFile
-	_, err = m.dbmap.Select(&files, "select * from files where localparentid = :localparentid and name = :name and op != :opdelete", map[string]interface{}{
-		"localparentid": localParentId,
-		"name":          name,
-		"opdelete":      OpDelete,
-	})
-	if err != nil || len(files) == 0 {
+	var file *CachedDriveFile
+	if file, err = getChildWithName(m.dbmap, localParentId, name); err != nil || file == nil {
 		return err
 	}
-	file := files[0]
+	var parentIds []int64
+	if parentIds, err = getParentIds(m.dbmap, file.LocalId); err != nil {
+		return
+	}
+	change.OldLocalParentIds = parentIds
+	newParentIds := []int64{}
+	for _, id := range parentIds {
+		if id == localParentId {
+			id = newParentId
+		}
+		if !containsId(newParentIds, id) {
+			newParentIds = append(newParentIds, id)
+		}
+	}
 	file.Name = newName
-	file.LocalParentId = newParentId
+	if file.LocalParentId == localParentId {
+		file.LocalParentId = newParentId
+	}
 	if newFileSize > -1 {
 		file.FileSize = newFileSize
 	}
 	file.LastMod = time.Now()
 	file.Op = OpUpload
-	_, err = m.dbmap.Update(file)
+	if isLocal {
+		file.Op = OpLocal
+	}
+	if _, err = m.dbmap.Update(file); err != nil {
+		return
+	}
+	if err = setParentIds(m.dbmap, file.LocalId, newParentIds); err != nil {
+		return
+	}
+	err = appendJournal(m.dbmap, &JournalEntry{
+		LocalId:          file.LocalId,
+		Kind:             JournalRename,
+		IsDir:            file.IsDir,
+		IsLocal:          isLocal,
+		OldLocalParentId: localParentId,
+		OldName:          name,
+		LocalParentId:    newParentId,
+		Name:             newName,
+	})
+	if err == nil {
+		change.set(file, newParentIds)
+	}
 	return err
 }
 
-func (m *MetaService) LocalRm(localParentId int64, name string, isDir bool) (err error) {
+// Updates the size of a file once its contents are written, queues
+// the contents for upload unless the file is local-only.
+func (m *MetaService) LocalWrite(localId int64, size int64) (err error) {
+	change := &Change{}
+	defer m.notify(change)
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	var files []*CachedDriveFile
-	_, err = m.dbmap.Select(&files, "select * from files where localparentid = :localparentid and name = :name and op != :opdelete", map[string]interface{}{
-		"localparentid": localParentId,
-		"name":          name,
-		"opdelete":      OpDelete,
+	var file *CachedDriveFile
+	if file, err = getByLocalId(m.dbmap, localId); err != nil || file == nil {
+		return err
+	}
+	var parentIds []int64
+	if parentIds, err = getParentIds(m.dbmap, file.LocalId); err != nil {
+		return
+	}
+	change.OldLocalParentIds, change.OldName = parentIds, file.Name
+	file.FileSize = size
+	file.LastMod = time.Now()
+	if file.Op != OpLocal {
+		file.Op = OpUpload
+	}
+	if _, err = m.dbmap.Update(file); err != nil {
+		return
+	}
+	err = appendJournal(m.dbmap, &JournalEntry{
+		LocalId:       file.LocalId,
+		Kind:          JournalModify,
+		IsLocal:       file.Op == OpLocal,
+		LocalParentId: file.LocalParentId,
+		Name:          file.Name,
 	})
-	if err != nil || len(files) == 0 {
+	if err == nil {
+		change.set(file, parentIds)
+	}
+	return err
+}
+
+func (m *MetaService) LocalRm(localParentId int64, name string, isDir bool) (err error) {
+	change := &Change{}
+	defer m.notify(change)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var file *CachedDriveFile
+	if file, err = getChildWithName(m.dbmap, localParentId, name); err != nil || file == nil {
 		return err
 	}
-	file := files[0]
+	var parentIds []int64
+	if parentIds, err = getParentIds(m.dbmap, file.LocalId); err != nil {
+		return
+	}
 	file.Op = OpDelete
-	_, err = m.dbmap.Update(file)
+	if _, err = m.dbmap.Update(file); err != nil {
+		return
+	}
+	err = appendJournal(m.dbmap, &JournalEntry{
+		LocalId:          file.LocalId,
+		Kind:             JournalRemove,
+		IsDir:            file.IsDir,
+		OldLocalParentId: localParentId,
+		OldName:          name,
+	})
+	if err == nil {
+		change.setRemoved(file, parentIds)
+	}
 	return err
 }
 
+// Adds localParentId to the parents of the file identified by
+// localId, the parent is queued to be added on the remote.
+func (m *MetaService) LocalLink(localId int64, localParentId int64) (err error) {
+	e := &JournalEntry{LocalId: localId, Kind: JournalLink, LocalParentId: localParentId}
+	return m.modParents(localId, e, func(parentIds []int64) []int64 {
+		if containsId(parentIds, localParentId) {
+			return parentIds
+		}
+		return append(parentIds, localParentId)
+	})
+}
+
+// Removes localParentId from the parents of the file identified by
+// localId, the parent is queued to be removed on the remote. The
+// file is not removed if it's its last parent.
+func (m *MetaService) LocalUnlink(localId int64, localParentId int64) (err error) {
+	e := &JournalEntry{LocalId: localId, Kind: JournalUnlink, OldLocalParentId: localParentId}
+	return m.modParents(localId, e, func(parentIds []int64) []int64 {
+		newParentIds := []int64{}
+		for _, id := range parentIds {
+			if id != localParentId {
+				newParentIds = append(newParentIds, id)
+			}
+		}
+		if len(newParentIds) == 0 {
+			return parentIds
+		}
+		return newParentIds
+	})
+}
+
+// Gets the local ids of the parents of the file identified by localId.
+func (m *MetaService) GetParentIds(localId int64) ([]int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.queries.getParentIds(localId)
+}
+
 func (m *MetaService) ListDownloads(limit int64, min int64, max int64) (files []*CachedDriveFile, err error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 	// TODO: order by lastMod
-	_, err = m.dbmap.Select(&files, "select * from files where op = :op and filesize >= :min and filesize < :max limit :limit", map[string]interface{}{
-		"op":    OpDownload,
-		"min":   min,
-		"max":   max,
+	_, err = m.dbmap.Select(&files, "select * from files where op in (:op, :opfetch) and filesize >= :min and filesize < :max limit :limit", map[string]interface{}{
+		"op":      OpDownload,
+		"opfetch": OpFetch,
+		"min":     min,
+		"max":     max,
+		"limit":   limit,
+	})
+	return files, err
+}
+
+// Lists at most limit files queued with op.
+func (m *MetaService) ListByOp(op int, limit int64) (files []*CachedDriveFile, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, err = m.dbmap.Select(&files, "select * from files where op = :op limit :limit", map[string]interface{}{
+		"op":    op,
 		"limit": limit,
 	})
 	return files, err
 }
 
-// Looks up for files under parentId, named with name.
-func (m *MetaService) GetChildrenWithName(localparentid int64, name string) (file *CachedDriveFile, err error) {
+// Enqueues all synced files that are not queued to be downloaded,
+// for when the cached blobs are lost.
+func (m *MetaService) QueueDownloads() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err := m.dbmap.Exec("update files set op = ? where op = ? and isdir = 0 and id != '' and linktarget = ''", OpDownload, OpNone)
+	return err
+}
+
+// Counts the files queued with op.
+func (m *MetaService) CountByOp(op int) (int64, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
+	return m.dbmap.SelectInt("select count(*) from files where op = ?", op)
+}
 
-	var files []*CachedDriveFile
-	_, err = m.dbmap.Select(&files, "select * from files where localparentid = :localparentid and name = :name and op != :opdelete", map[string]interface{}{
-		"localparentid": localparentid,
-		"name":          name,
-		"opdelete":      OpDelete,
-	})
-	if err != nil || len(files) == 0 {
-		return nil, err
+// Gets the file or folder at the slash separated path p relative
+// to the root, returns nil if there is no such file.
+func (m *MetaService) GetByPath(p string) (file *CachedDriveFile, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if file, err = m.queries.getByRemoteId(IdRoot); err != nil || file == nil {
+		return
 	}
-	return files[0], nil
+	for _, name := range strings.Split(path.Clean("/"+p), "/") {
+		if name == "" {
+			continue
+		}
+		if file, err = m.queries.getChildWithName(file.LocalId, name); err != nil || file == nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// Looks up for files under parentId, named with name.
+func (m *MetaService) GetChildrenWithName(localparentid int64, name string) (file *CachedDriveFile, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.queries.getChildWithName(localparentid, name)
 }
 
 // Gets the children of folder identified by parentId.
 func (m *MetaService) GetChildren(localparentid int64) (files []*CachedDriveFile, err error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
-	_, err = m.dbmap.Select(&files, "select * from files where localparentid = :localparentid and op != :opdelete", map[string]interface{}{
-		"localparentid": localparentid,
-		"opdelete":      OpDelete,
-	})
+	return m.queries.getChildren(localparentid)
+}
+
+// Gets the file or folder identified by remoteId.
+func (m *MetaService) GetByRemoteId(remoteId string) (file *CachedDriveFile, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.queries.getByRemoteId(remoteId)
+}
+
+// Gets the slash separated path of the file or folder identified by
+// localId relative to the root, paths are resolved through the first
+// parents.
+func (m *MetaService) GetPath(localId int64) (p string, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var file *CachedDriveFile
+	for depth := 0; depth < maxPathDepth; depth++ {
+		if file, err = m.queries.getByLocalId(localId); err != nil || file == nil || file.LocalParentId == 0 {
+			return
+		}
+		p = path.Join(file.Name, p)
+		localId = file.LocalParentId
+	}
 	return
 }
 
+// Gets the file or folder identified by localId.
+func (m *MetaService) GetByLocalId(localId int64) (file *CachedDriveFile, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.queries.getByLocalId(localId)
+}
+
 // Enqueues a file into the upload or download queue.
 func (m *MetaService) SetOp(localId int64, op int) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return setOp(m.dbmap, localId, op)
+}
+
+// Links a locally created or written file to the remote file it's
+// uploaded as, the contents uploaded have the given checksum.
+func (m *MetaService) SetUploaded(localId int64, remoteId string, checksum string) (err error) {
+	change := &Change{}
+	defer m.notify(change)
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	var file *CachedDriveFile
-	if file, err = m.getByLocalId(localId); err != nil {
+	if file, err = getByLocalId(m.dbmap, localId); err != nil || file == nil {
 		return err
 	}
-	file.Op = op
-	_, err = m.dbmap.Update(file)
+	var parentIds []int64
+	if parentIds, err = getParentIds(m.dbmap, file.LocalId); err != nil {
+		return
+	}
+	change.OldLocalParentIds, change.OldName = parentIds, file.Name
+	file.Id = remoteId
+	file.Md5Checksum = checksum
+	if _, err = m.dbmap.Update(file); err == nil {
+		change.set(file, parentIds)
+	}
 	return err
 }
 
@@ -255,7 +504,7 @@ func (m *MetaService) GetLargestChangeId() (largestId int64, err error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 	var val string
-	if val, err = m.getKey(keyLargestChangeId); err != nil {
+	if val, err = getKey(m.dbmap, keyLargestChangeId); err != nil {
 		return
 	}
 	largestId, err = strconv.ParseInt(val, 0, 64)
@@ -266,29 +515,289 @@ func (m *MetaService) GetLargestChangeId() (largestId int64, err error) {
 func (m *MetaService) SaveLargestChangeId(id int64) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	logger.V("Saving largest change Id", id)
-	e := &KeyValueEntry{Key: keyLargestChangeId, Value: fmt.Sprintf("%d", id)}
-	val, err := m.getKey(keyLargestChangeId)
-	if err != nil {
-		return err
+	return saveLargestChangeId(m.dbmap, id)
+}
+
+// Closes the underlying database.
+func (m *MetaService) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queries.close()
+	return m.dbmap.Db.Close()
+}
+
+// Publishes a change once it's persisted, it's called without
+// holding any metadata locks.
+func (m *MetaService) notify(change *Change) {
+	if change.LocalId == 0 {
+		return
 	}
-	if val == "" {
-		return m.dbmap.Insert(e)
+	e := &events.Event{
+		Type:              events.FileChanged,
+		LocalId:           change.LocalId,
+		RemoteId:          change.RemoteId,
+		Name:              change.Name,
+		LocalParentIds:    change.LocalParentIds,
+		OldName:           change.OldName,
+		OldLocalParentIds: change.OldLocalParentIds,
+		IsRemote:          change.IsRemote,
 	}
-	_, err = m.dbmap.Update(e)
-	return err
+	if change.Name == "" {
+		e.Type = events.FileRemoved
+	} else if change.OldName == "" {
+		e.Type = events.FileAdded
+	}
+	m.bus.Publish(e)
+	if change.IsConflict {
+		m.bus.Publish(&events.Event{
+			Type:     events.Conflict,
+			LocalId:  change.LocalId,
+			RemoteId: change.RemoteId,
+			Name:     change.Name,
+			IsRemote: true,
+		})
+	}
+}
+
+func (c *Change) set(file *CachedDriveFile, parentIds []int64) {
+	c.LocalId = file.LocalId
+	c.RemoteId = file.Id
+	c.LocalParentIds = parentIds
+	c.Name = file.Name
+}
+
+func (c *Change) setRemoved(file *CachedDriveFile, parentIds []int64) {
+	c.LocalId = file.LocalId
+	c.RemoteId = file.Id
+	c.OldLocalParentIds = parentIds
+	c.OldName = file.Name
 }
 
-// Sets up the sqlite db, creates required tables and indexes.
+// Sets up the sqlite db, creates required tables and indexes,
+// migrates the existing ones.
 func (m *MetaService) setup() error {
 	m.dbmap.AddTableWithName(CachedDriveFile{}, "files").SetKeys(true, "LocalId")
 	m.dbmap.AddTableWithName(KeyValueEntry{}, "info").SetKeys(false, "Key")
-	return m.dbmap.CreateTablesIfNotExists()
+	m.dbmap.AddTableWithName(ParentEntry{}, "parents").SetKeys(false, "LocalId", "LocalParentId")
+	m.dbmap.AddTableWithName(JournalEntry{}, "journal").SetKeys(true, "Seq")
+	if err := m.migrate(); err != nil {
+		return err
+	}
+	for _, q := range indexes {
+		if _, err := m.dbmap.Exec(q); err != nil {
+			return err
+		}
+	}
+	// lookups are not blocked while the changes are written
+	return m.pragma("journal_mode = wal")
 }
 
-func (m *MetaService) getByRemoteId(remoteId string) (*CachedDriveFile, error) {
+// Runs a pragma, its result is discarded. Pragmas are queried
+// rather than executed, statements executed by the sqlite driver
+// are not finalized and would keep the database locked.
+func (m *MetaService) pragma(p string) error {
+	rows, err := m.dbmap.Db.Query("pragma " + p)
+	if err != nil {
+		return err
+	}
+	return rows.Close()
+}
+
+// Replaces the parents of the file identified by localId with the
+// ones fn returns, e is journaled unless a parent is added or
+// removed.
+func (m *MetaService) modParents(localId int64, e *JournalEntry, fn func([]int64) []int64) (err error) {
+	change := &Change{}
+	defer m.notify(change)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var file *CachedDriveFile
+	if file, err = getByLocalId(m.dbmap, localId); err != nil || file == nil {
+		return
+	}
+	var parentIds []int64
+	if parentIds, err = getParentIds(m.dbmap, localId); err != nil {
+		return
+	}
+	newParentIds := fn(parentIds)
+	if len(newParentIds) == len(parentIds) {
+		return
+	}
+	if len(newParentIds) > 0 && !containsId(newParentIds, file.LocalParentId) {
+		file.LocalParentId = newParentIds[0]
+		if _, err = m.dbmap.Update(file); err != nil {
+			return
+		}
+	}
+	if err = setParentIds(m.dbmap, localId, newParentIds); err != nil {
+		return
+	}
+	e.IsDir = file.IsDir
+	e.IsLocal = file.Op == OpLocal
+	if err = appendJournal(m.dbmap, e); err == nil {
+		change.set(file, newParentIds)
+		change.OldLocalParentIds = parentIds
+		change.OldName = file.Name
+	}
+	return
+}
+
+func remoteMod(exec gorp.SqlExecutor, change *Change, remoteId string, parentRemoteIds []string, data *CachedDriveFile) (err error) {
+	logger.V("Caching metadata for", remoteId)
+	var parentIds []int64
+	for _, id := range parentRemoteIds {
+		var parentFile *CachedDriveFile
+		if parentFile, err = getByRemoteId(exec, id); err != nil {
+			return err
+		}
+		if parentFile != nil {
+			parentIds = append(parentIds, parentFile.LocalId)
+		}
+	}
+
+	var file *CachedDriveFile
+	if file, err = getByRemoteId(exec, remoteId); err != nil {
+		return err
+	}
+	if file == nil {
+		file = &CachedDriveFile{Id: remoteId}
+	} else if file.Op != OpDelete {
+		if change.OldLocalParentIds, err = getParentIds(exec, file.LocalId); err != nil {
+			return err
+		}
+		change.OldName = file.Name
+	}
+	if file.Op == OpDelete {
+		// restored from the trash, blob might be already removed
+		file.Op = OpNone
+		if !data.IsDir {
+			file.Op = OpDownload
+		}
+	}
+	if data.Md5Checksum != file.Md5Checksum && !data.IsDir {
+		isPending := false
+		if file.Op == OpUpload {
+			if isPending, err = hasJournal(exec, file.LocalId); err != nil {
+				return
+			}
+		}
+		// local modifications yet to be uploaded override the remote
+		change.IsConflict = file.Op == OpUpload
+		if !isPending {
+			file.Op = OpDownload
+		}
+	}
+	if data.LinkTarget != "" {
+		// symlink targets are kept in metadata, no need to download
+		file.Op = OpNone
+	}
+	file.Id = remoteId
+
+	file.Name = data.Name
+	file.LastMod = data.LastMod
+	file.Md5Checksum = data.Md5Checksum
+	file.LastEtag = data.LastEtag
+	file.FileSize = data.FileSize
+	file.IsDir = data.IsDir
+	file.LinkTarget = data.LinkTarget
+	file.MimeType = data.MimeType
+	file.LocalParentId = 0
+	if len(parentIds) > 0 {
+		file.LocalParentId = parentIds[0]
+	}
+	if file.LocalId > 0 {
+		_, err = exec.Update(file)
+	} else {
+		err = exec.Insert(file)
+	}
+	if err != nil {
+		return
+	}
+	if err = setParentIds(exec, file.LocalId, parentIds); err == nil {
+		change.set(file, parentIds)
+	}
+	return
+}
+
+func remoteRm(exec gorp.SqlExecutor, change *Change, remoteId string) (err error) {
+	// TODO: Handle directories recursively
+	logger.V("Deleting metadata for", remoteId)
+	var file *CachedDriveFile
+	if file, err = getByRemoteId(exec, remoteId); err != nil {
+		return err
+	}
+	if file == nil {
+		return
+	}
+	var parentIds []int64
+	if parentIds, err = getParentIds(exec, file.LocalId); err != nil {
+		return
+	}
+	file.Op = OpDelete
+	if _, err = exec.Update(file); err == nil {
+		change.setRemoved(file, parentIds)
+	}
+	return err
+}
+
+func setOp(exec gorp.SqlExecutor, localId int64, op int) (err error) {
+	var file *CachedDriveFile
+	if file, err = getByLocalId(exec, localId); err != nil || file == nil {
+		return err
+	}
+	file.Op = op
+	_, err = exec.Update(file)
+	return err
+}
+
+func saveLargestChangeId(exec gorp.SqlExecutor, id int64) error {
+	logger.V("Saving largest change Id", id)
+	return setKey(exec, keyLargestChangeId, fmt.Sprintf("%d", id))
+}
+
+func getChildWithName(exec gorp.SqlExecutor, localParentId int64, name string) (*CachedDriveFile, error) {
 	var files []*CachedDriveFile
-	_, err := m.dbmap.Select(&files, "select * from files where id = :remoteid", map[string]interface{}{
+	_, err := exec.Select(&files, "select files.* from files inner join parents on files.localid = parents.localid where parents.localparentid = :localparentid and files.name = :name and files.op != :opdelete", map[string]interface{}{
+		"localparentid": localParentId,
+		"name":          name,
+		"opdelete":      OpDelete,
+	})
+	if err != nil || len(files) == 0 {
+		return nil, err
+	}
+	return files[0], nil
+}
+
+func getParentIds(exec gorp.SqlExecutor, localId int64) (parentIds []int64, err error) {
+	_, err = exec.Select(&parentIds, "select localparentid from parents where localid = ?", localId)
+	return
+}
+
+// Replaces the parents of the file identified by localId.
+func setParentIds(exec gorp.SqlExecutor, localId int64, parentIds []int64) (err error) {
+	if _, err = exec.Exec("delete from parents where localid = ?", localId); err != nil {
+		return
+	}
+	for _, id := range parentIds {
+		if err = exec.Insert(&ParentEntry{LocalId: localId, LocalParentId: id}); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func containsId(ids []int64, id int64) bool {
+	for _, item := range ids {
+		if item == id {
+			return true
+		}
+	}
+	return false
+}
+
+func getByRemoteId(exec gorp.SqlExecutor, remoteId string) (*CachedDriveFile, error) {
+	var files []*CachedDriveFile
+	_, err := exec.Select(&files, "select * from files where id = :remoteid", map[string]interface{}{
 		"remoteid": remoteId,
 	})
 	if err != nil || len(files) == 0 {
@@ -297,9 +806,9 @@ func (m *MetaService) getByRemoteId(remoteId string) (*CachedDriveFile, error) {
 	return files[0], err
 }
 
-func (m *MetaService) getByLocalId(localId int64) (*CachedDriveFile, error) {
+func getByLocalId(exec gorp.SqlExecutor, localId int64) (*CachedDriveFile, error) {
 	var files []*CachedDriveFile
-	_, err := m.dbmap.Select(&files, "select * from files where localid = :id", map[string]interface{}{
+	_, err := exec.Select(&files, "select * from files where localid = :id", map[string]interface{}{
 		"id": localId,
 	})
 	if err != nil || len(files) == 0 {
@@ -308,9 +817,22 @@ func (m *MetaService) getByLocalId(localId int64) (*CachedDriveFile, error) {
 	return files[0], err
 }
 
-func (m *MetaService) getKey(key string) (value string, err error) {
+func setKey(exec gorp.SqlExecutor, key string, value string) error {
+	e := &KeyValueEntry{Key: key, Value: value}
+	val, err := getKey(exec, key)
+	if err != nil {
+		return err
+	}
+	if val == "" {
+		return exec.Insert(e)
+	}
+	_, err = exec.Update(e)
+	return err
+}
+
+func getKey(exec gorp.SqlExecutor, key string) (value string, err error) {
 	var vals []string
-	_, err = m.dbmap.Select(&vals, "select value from info where key = ?", key)
+	_, err = exec.Select(&vals, "select value from info where key = ?", key)
 	if err != nil || len(vals) == 0 {
 		return
 	}
@@ -0,0 +1,247 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Run with go test -bench . -files 500000 ./metadata
+var (
+	benchFiles  = flag.Int("files", 100000, "number of files in the synthetic tree benchmarks run against")
+	benchFanout = flag.Int("fanout", 50, "number of children of each folder in the synthetic tree")
+)
+
+var (
+	benchOnce sync.Once
+	benchDir  string
+	benchMeta *MetaService
+	benchErr  error
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	code := m.Run()
+	if benchMeta != nil {
+		benchMeta.Close()
+	}
+	if benchDir != "" {
+		os.RemoveAll(benchDir)
+	}
+	os.Exit(code)
+}
+
+// Gets the metadata of a synthetic tree, the tree is built once
+// and shared by the benchmarks. Files are numbered breadth first
+// from the root, each folder has fanout children.
+func benchTree(b *testing.B) *MetaService {
+	benchOnce.Do(func() {
+		if benchDir, benchErr = ioutil.TempDir("", "drivefuse-bench"); benchErr != nil {
+			return
+		}
+		if benchMeta, benchErr = New(filepath.Join(benchDir, "meta.sql"), nil); benchErr != nil {
+			return
+		}
+		benchErr = populate(benchMeta.dbmap.Db, *benchFiles, *benchFanout)
+	})
+	if benchErr != nil {
+		b.Fatal(benchErr)
+	}
+	b.ResetTimer()
+	return benchMeta
+}
+
+// Inserts n files in a single transaction, bypasses the metadata
+// service to build large trees quickly.
+func populate(db *sql.DB, n int, fanout int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	insertFile, err := tx.Prepare("insert into files (localid, localparentid, id, name, lastmod, md5checksum, lastetag, filesize, isdir, linktarget, mimetype, op) values (?, ?, ?, ?, ?, ?, ?, ?, ?, '', '', ?)")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	insertParent, err := tx.Prepare("insert into parents (localid, localparentid) values (?, ?)")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	now := time.Now()
+	for i := 1; i <= n; i++ {
+		id := benchRemoteId(i)
+		isDir := benchIsDir(i, n, fanout)
+		op := OpNone
+		if !isDir && i%10 == 0 {
+			op = OpDownload
+		}
+		parentId := int64(benchParentOf(i, fanout))
+		_, err = insertFile.Exec(i, parentId, id, benchName(i), now, "", "", int64(i%(4<<20)), isDir, op)
+		if err == nil && parentId > 0 {
+			_, err = insertParent.Exec(i, parentId)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func benchParentOf(i int, fanout int) int {
+	if i == 1 {
+		return 0
+	}
+	return 1 + (i-2)/fanout
+}
+
+func benchIsDir(i int, n int, fanout int) bool {
+	return 2+(i-1)*fanout <= n
+}
+
+func benchRemoteId(i int) string {
+	if i == 1 {
+		return IdRoot
+	}
+	return fmt.Sprintf("remote-%d", i)
+}
+
+func benchName(i int) string {
+	if i == 1 {
+		return ""
+	}
+	return fmt.Sprintf("file-%d", i)
+}
+
+// Gets a random file other than the root.
+func benchFile(r *rand.Rand) int {
+	return 2 + r.Intn(*benchFiles-1)
+}
+
+// Gets a random folder.
+func benchFolder(r *rand.Rand) int {
+	for {
+		if i := 1 + r.Intn(*benchFiles); benchIsDir(i, *benchFiles, *benchFanout) {
+			return i
+		}
+	}
+}
+
+func BenchmarkGetChildrenWithName(b *testing.B) {
+	m := benchTree(b)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < b.N; i++ {
+		f := benchFile(r)
+		file, err := m.GetChildrenWithName(int64(benchParentOf(f, *benchFanout)), benchName(f))
+		if err != nil || file == nil {
+			b.Fatal("missing file", f, err)
+		}
+	}
+}
+
+func BenchmarkGetChildren(b *testing.B) {
+	m := benchTree(b)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < b.N; i++ {
+		if _, err := m.GetChildren(int64(benchFolder(r))); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetByRemoteId(b *testing.B) {
+	m := benchTree(b)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < b.N; i++ {
+		if file, err := m.GetByRemoteId(benchRemoteId(benchFile(r))); err != nil || file == nil {
+			b.Fatal("missing file", err)
+		}
+	}
+}
+
+func BenchmarkGetByLocalId(b *testing.B) {
+	m := benchTree(b)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < b.N; i++ {
+		if file, err := m.GetByLocalId(int64(benchFile(r))); err != nil || file == nil {
+			b.Fatal("missing file", err)
+		}
+	}
+}
+
+func BenchmarkGetByPath(b *testing.B) {
+	m := benchTree(b)
+	// resolve the deepest files
+	paths := make([]string, 0, 100)
+	for f := *benchFiles; f > 1 && len(paths) < cap(paths); f-- {
+		p, err := m.GetPath(int64(f))
+		if err != nil {
+			b.Fatal(err)
+		}
+		paths = append(paths, p)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if file, err := m.GetByPath(paths[i%len(paths)]); err != nil || file == nil {
+			b.Fatal("missing file", paths[i%len(paths)], err)
+		}
+	}
+}
+
+func BenchmarkListDownloads(b *testing.B) {
+	m := benchTree(b)
+	for i := 0; i < b.N; i++ {
+		if _, err := m.ListDownloads(5, 0, 1<<20); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCountByOp(b *testing.B) {
+	m := benchTree(b)
+	for i := 0; i < b.N; i++ {
+		if _, err := m.CountByOp(OpDownload); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRemoteMod(b *testing.B) {
+	m := benchTree(b)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < b.N; i++ {
+		f := benchFile(r)
+		data := &CachedDriveFile{
+			Name:     benchName(f),
+			LastMod:  time.Now(),
+			FileSize: int64(f),
+			IsDir:    benchIsDir(f, *benchFiles, *benchFanout),
+		}
+		parentId := benchRemoteId(benchParentOf(f, *benchFanout))
+		if err := m.RemoteMod(benchRemoteId(f), []string{parentId}, data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Contains tests for metadata package.
+package metadata
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	T "github.com/rakyll/drivefuse/third_party/launchpad.net/gocheck"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) {
+	T.TestingT(t)
+}
+
+type fileExistsChecker struct {
+	*T.CheckerInfo
+}
+
+func (checker *fileExistsChecker) Check(params []interface{}, names []string) (bool, string) {
+	if _, err := os.Stat(params[0].(string)); err != nil {
+		return false, err.Error()
+	}
+	return true, ""
+}
+
+var fileExists T.Checker = &fileExistsChecker{
+	&T.CheckerInfo{Name: "FileExists", Params: []string{"path"}},
+}
+
+type MigrateSuite struct {
+	dbPath string
+}
+
+var _ = T.Suite(&MigrateSuite{})
+
+func (s *MigrateSuite) SetUpTest(c *T.C) {
+	s.dbPath = filepath.Join(c.MkDir(), "meta.sql")
+}
+
+// Schema and contents of a database created before the schema
+// is versioned, files have no link targets and no parents table.
+var fixtureVersion0 = []string{
+	`create table if not exists "files" ("LocalId" integer not null primary key autoincrement, "LocalParentId" integer, "Id" varchar(255), "Name" varchar(255), "LastMod" datetime, "Md5Checksum" varchar(255), "LastEtag" varchar(255), "FileSize" integer, "IsDir" integer, "Op" integer)`,
+	`create table if not exists "info" ("Key" varchar(255) not null primary key, "Value" varchar(255))`,
+	`insert into files values (1, 0, 'root', 'My Drive', '2013-10-01 10:00:00', '', 'e1', 0, 1, 0)`,
+	`insert into files values (2, 1, 'folder', 'folder', '2013-10-01 10:00:00', '', 'e2', 0, 1, 0)`,
+	`insert into files values (3, 2, 'file', 'file.txt', '2013-10-01 10:00:00', 'md5', 'e3', 12, 0, 1)`,
+	`insert into files values (4, 1, 'folder', 'folder', '2013-10-01 10:00:00', '', 'e2', 0, 1, 0)`,
+	`insert into files values (5, 4, 'other', 'other.txt', '2013-10-01 10:00:00', 'md5', 'e5', 12, 0, 0)`,
+	`insert into files values (6, 1, '', 'created', '2013-10-01 10:00:00', '', '', 0, 1, 2)`,
+	`insert into files values (7, 6, '', 'created.txt', '2013-10-01 10:00:00', '', '', 0, 0, 2)`,
+	`insert into files values (8, 1, 'removed', 'removed.txt', '2013-10-01 10:00:00', 'md5', 'e8', 12, 0, 3)`,
+	`insert into info values ('largest-change-id', '42')`,
+}
+
+func (s *MigrateSuite) createFixture(c *T.C, stmts []string) {
+	db, err := sql.Open("sqlite3", s.dbPath)
+	c.Assert(err, T.IsNil)
+	defer db.Close()
+	for _, stmt := range stmts {
+		_, err = db.Exec(stmt)
+		c.Assert(err, T.IsNil)
+	}
+}
+
+func (s *MigrateSuite) TestMigrateVersion0(c *T.C) {
+	s.createFixture(c, fixtureVersion0)
+	m, err := New(s.dbPath, nil)
+	c.Assert(err, T.IsNil)
+	defer m.Close()
+
+	c.Assert(s.dbPath+".v0.bak", fileExists)
+	version, err := getKey(m.dbmap, keySchemaVersion)
+	c.Assert(err, T.IsNil)
+	c.Assert(version, T.Equals, strconv.Itoa(schemaVersion))
+	id, err := m.GetLargestChangeId()
+	c.Assert(err, T.IsNil)
+	c.Assert(id, T.Equals, int64(42))
+
+	file, err := m.GetByPath("folder/file.txt")
+	c.Assert(err, T.IsNil)
+	c.Assert(file, T.NotNil)
+	c.Assert(file.LocalId, T.Equals, int64(3))
+	c.Assert(file.LinkTarget, T.Equals, "")
+	c.Assert(file.Op, T.Equals, OpDownload)
+
+	// children of the duplicate are moved under the folder kept
+	file, err = m.GetByPath("folder/other.txt")
+	c.Assert(err, T.IsNil)
+	c.Assert(file, T.NotNil)
+	c.Assert(file.LocalParentId, T.Equals, int64(2))
+	folder, err := m.GetByLocalId(4)
+	c.Assert(err, T.IsNil)
+	c.Assert(folder, T.IsNil)
+
+	// local changes are replayed once they are journaled
+	entries, err := m.ListJournal(10)
+	c.Assert(err, T.IsNil)
+	c.Assert(entries, T.HasLen, 3)
+	c.Assert(entries[0].LocalId, T.Equals, int64(6))
+	c.Assert(entries[0].Kind, T.Equals, JournalCreate)
+	c.Assert(entries[0].IsDir, T.Equals, true)
+	c.Assert(entries[1].LocalId, T.Equals, int64(7))
+	c.Assert(entries[1].LocalParentId, T.Equals, int64(6))
+	c.Assert(entries[1].Name, T.Equals, "created.txt")
+	c.Assert(entries[2].LocalId, T.Equals, int64(8))
+	c.Assert(entries[2].Kind, T.Equals, JournalRemove)
+	c.Assert(entries[2].OldLocalParentId, T.Equals, int64(1))
+	c.Assert(entries[2].OldName, T.Equals, "removed.txt")
+
+	// symlinks and types can be cached once the columns are added
+	err = m.RemoteMod("link", []string{"folder"}, &CachedDriveFile{Name: "link", LinkTarget: "file.txt", MimeType: MimeTypeSymlink})
+	c.Assert(err, T.IsNil)
+	file, err = m.GetByPath("folder/link")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.LinkTarget, T.Equals, "file.txt")
+	c.Assert(file.MimeType, T.Equals, MimeTypeSymlink)
+}
+
+func (s *MigrateSuite) TestMigrateReopen(c *T.C) {
+	s.createFixture(c, fixtureVersion0)
+	m, err := New(s.dbPath, nil)
+	c.Assert(err, T.IsNil)
+	c.Assert(m.Close(), T.IsNil)
+	m, err = New(s.dbPath, nil)
+	c.Assert(err, T.IsNil)
+	c.Assert(m.Close(), T.IsNil)
+}
+
+func (s *MigrateSuite) TestNewDatabase(c *T.C) {
+	m, err := New(s.dbPath, nil)
+	c.Assert(err, T.IsNil)
+	defer m.Close()
+	_, err = os.Stat(s.dbPath + ".v0.bak")
+	c.Assert(os.IsNotExist(err), T.Equals, true)
+	version, err := getKey(m.dbmap, keySchemaVersion)
+	c.Assert(err, T.IsNil)
+	c.Assert(version, T.Equals, strconv.Itoa(schemaVersion))
+}
+
+func (s *MigrateSuite) TestMigrateExistingColumns(c *T.C) {
+	// columns added by migrations might be created with the table
+	m, err := New(s.dbPath, nil)
+	c.Assert(err, T.IsNil)
+	_, err = m.dbmap.Exec("update info set value = '3' where key = ?", keySchemaVersion)
+	c.Assert(err, T.IsNil)
+	c.Assert(m.Close(), T.IsNil)
+	m, err = New(s.dbPath, nil)
+	c.Assert(err, T.IsNil)
+	defer m.Close()
+	version, err := getKey(m.dbmap, keySchemaVersion)
+	c.Assert(err, T.IsNil)
+	c.Assert(version, T.Equals, strconv.Itoa(schemaVersion))
+}
+
+func (s *MigrateSuite) TestNewerVersion(c *T.C) {
+	s.createFixture(c, append(fixtureVersion0, `insert into info values ('schema-version', '999')`))
+	_, err := New(s.dbPath, nil)
+	c.Assert(err, T.ErrorMatches, "metadata schema version 999 is newer .*")
+}
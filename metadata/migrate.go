@@ -0,0 +1,220 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/rakyll/drivefuse/logger"
+	"github.com/rakyll/drivefuse/third_party/github.com/coopernurse/gorp"
+)
+
+const (
+	keySchemaVersion = "schema-version"
+)
+
+// migration upgrades the schema from the previous version. New
+// tables are created before migrating, migrations alter the
+// existing ones and convert their data.
+type migration struct {
+	version     int
+	description string
+	migrate     func(exec gorp.SqlExecutor) error
+}
+
+// Migrations ordered by version, new ones are appended.
+var migrations = []*migration{
+	{1, "link the files cached before the parents table to their parents", func(exec gorp.SqlExecutor) error {
+		_, err := exec.Exec("insert or ignore into parents (localid, localparentid) select localid, localparentid from files where localparentid > 0")
+		return err
+	}},
+	{2, "journal the local changes made before the journal table", func(exec gorp.SqlExecutor) error {
+		// the table is created with the other tables, locally created
+		// files are queued for upload and removed files are trashed.
+		// Old locations of the renamed files are unknown, they are
+		// not journaled.
+		if _, err := exec.Exec("insert into journal (localid, kind, isdir, islocal, oldlocalparentid, oldname, localparentid, name, time) select localid, ?, isdir, 0, 0, '', localparentid, name, lastmod from files where id = '' and op = ? order by localid", JournalCreate, OpUpload); err != nil {
+			return err
+		}
+		_, err := exec.Exec("insert into journal (localid, kind, isdir, islocal, oldlocalparentid, oldname, localparentid, name, time) select localid, ?, isdir, 0, localparentid, name, 0, '', lastmod from files where id != '' and op = ? order by localid", JournalRemove, OpDelete)
+		return err
+	}},
+	{3, "remove the duplicates of files to index remote ids uniquely", func(exec gorp.SqlExecutor) error {
+		duplicates := "select localid from files as f where id != '' and localid > (select min(localid) from files where id = f.id)"
+		// children of the duplicates are moved under the file kept
+		kept := "(select min(k.localid) from files as k inner join files as d on k.id = d.id where d.localid = %s.localparentid)"
+		if _, err := exec.Exec("update or ignore parents set localparentid = " + fmt.Sprintf(kept, "parents") + " where localparentid in (" + duplicates + ")"); err != nil {
+			return err
+		}
+		if _, err := exec.Exec("update files set localparentid = " + fmt.Sprintf(kept, "files") + " where localparentid in (" + duplicates + ")"); err != nil {
+			return err
+		}
+		if _, err := exec.Exec("delete from parents where localparentid in (" + duplicates + ")"); err != nil {
+			return err
+		}
+		for _, table := range []string{"parents", "journal", "files"} {
+			if _, err := exec.Exec("delete from " + table + " where localid in (" + duplicates + ")"); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{4, "add the link target column of symlinks", func(exec gorp.SqlExecutor) error {
+		// databases created since symlinks are supported have it
+		if ok, err := hasColumn(exec, "files", "linktarget"); err != nil || ok {
+			return err
+		}
+		_, err := exec.Exec("alter table files add column linktarget varchar(255) not null default ''")
+		return err
+	}},
+	{5, "add the mime type column evaluated by rules", func(exec gorp.SqlExecutor) error {
+		// databases created since rules match types have it, types
+		// of the cached files are unknown until they change
+		if ok, err := hasColumn(exec, "files", "mimetype"); err != nil || ok {
+			return err
+		}
+		_, err := exec.Exec("alter table files add column mimetype varchar(255) not null default ''")
+		return err
+	}},
+}
+
+// Version of the schema the tables are created with.
+var schemaVersion = migrations[len(migrations)-1].version
+
+// Creates the missing tables and migrates the existing database
+// to the latest schema version, one version at a time. The
+// database is backed up before migrating.
+func (m *MetaService) migrate() (err error) {
+	var isNew bool
+	if isNew, err = m.isNew(); err != nil {
+		return
+	}
+	var version int
+	if !isNew {
+		if version, err = m.schemaVersion(); err != nil {
+			return
+		}
+	}
+	if version > schemaVersion {
+		return fmt.Errorf("metadata schema version %d is newer than the supported version %d", version, schemaVersion)
+	}
+	if !isNew && version < schemaVersion {
+		backupPath := fmt.Sprintf("%s.v%d.bak", m.dbPath, version)
+		logger.V("Backing up metadata to", backupPath)
+		// move the changes logged in wal mode into the database
+		if err = m.pragma("wal_checkpoint(truncate)"); err != nil {
+			return
+		}
+		if err = copyFile(m.dbPath, backupPath); err != nil {
+			return fmt.Errorf("error backing up metadata: %v", err)
+		}
+	}
+	if err = m.dbmap.CreateTablesIfNotExists(); err != nil {
+		return
+	}
+	if isNew {
+		return setKey(m.dbmap, keySchemaVersion, strconv.Itoa(schemaVersion))
+	}
+	for _, mig := range migrations {
+		if mig.version <= version {
+			continue
+		}
+		logger.V("Migrating metadata to schema version", mig.version, "-", mig.description)
+		var tx *gorp.Transaction
+		if tx, err = m.dbmap.Begin(); err != nil {
+			return
+		}
+		if err = mig.migrate(tx); err == nil {
+			err = setKey(tx, keySchemaVersion, strconv.Itoa(mig.version))
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error migrating metadata to schema version %d: %v", mig.version, err)
+		}
+		if err = tx.Commit(); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Tests whether the database has no tables yet.
+func (m *MetaService) isNew() (bool, error) {
+	n, err := m.dbmap.SelectInt("select count(*) from sqlite_master where type = 'table' and name = 'files'")
+	return n == 0, err
+}
+
+// Gets the schema version of an existing database, databases
+// created before versioning are at version 0.
+func (m *MetaService) schemaVersion() (int, error) {
+	n, err := m.dbmap.SelectInt("select count(*) from sqlite_master where type = 'table' and name = 'info'")
+	if err != nil || n == 0 {
+		return 0, err
+	}
+	val, err := getKey(m.dbmap, keySchemaVersion)
+	if err != nil || val == "" {
+		return 0, err
+	}
+	return strconv.Atoi(val)
+}
+
+// columnInfo is a row of the table_info pragma.
+type columnInfo struct {
+	Cid     int64          `db:"cid"`
+	Name    string         `db:"name"`
+	Type    string         `db:"type"`
+	NotNull int64          `db:"notnull"`
+	Default sql.NullString `db:"dflt_value"`
+	Pk      int64          `db:"pk"`
+}
+
+// Tests whether the table has the named column.
+func hasColumn(exec gorp.SqlExecutor, table string, column string) (bool, error) {
+	var cols []*columnInfo
+	if _, err := exec.Select(&cols, "pragma table_info("+table+")"); err != nil {
+		return false, err
+	}
+	for _, col := range cols {
+		if strings.EqualFold(col.Name, column) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func copyFile(src, dst string) (err error) {
+	var in, out *os.File
+	if in, err = os.Open(src); err != nil {
+		return
+	}
+	defer in.Close()
+	if out, err = os.Create(dst); err != nil {
+		return
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return
+	}
+	if err = out.Sync(); err != nil {
+		out.Close()
+		return
+	}
+	return out.Close()
+}
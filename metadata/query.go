@@ -13,3 +13,119 @@
 // limitations under the License.
 
 package metadata
+
+import (
+	"database/sql"
+)
+
+// Columns of the files table in the order they are scanned.
+const fileColumns = "files.localid, files.localparentid, files.id, files.name, files.lastmod, files.md5checksum, files.lastetag, files.filesize, files.isdir, files.linktarget, files.mimetype, files.op"
+
+// Indexes of the lookups done for each file system request, created
+// once the tables are migrated.
+var indexes = []string{
+	"create unique index if not exists files_id on files (id) where id != ''",
+	"create index if not exists files_op on files (op, filesize)",
+	"create index if not exists files_parent_name on files (localparentid, name)",
+	"create index if not exists parents_parent on parents (localparentid)",
+	"create index if not exists journal_localid on journal (localid)",
+}
+
+// queries are the lookups done for each file system request,
+// prepared once the database is opened. Lookups in transactions
+// are not prepared.
+type queries struct {
+	childWithName *sql.Stmt
+	children      *sql.Stmt
+	byRemoteId    *sql.Stmt
+	byLocalId     *sql.Stmt
+	parentIds     *sql.Stmt
+}
+
+func prepareQueries(db *sql.DB) (q *queries, err error) {
+	q = &queries{}
+	stmts := []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&q.childWithName, "select " + fileColumns + " from files inner join parents on files.localid = parents.localid where parents.localparentid = ? and files.name = ? and files.op != ? limit 1"},
+		{&q.children, "select " + fileColumns + " from files inner join parents on files.localid = parents.localid where parents.localparentid = ? and files.op != ?"},
+		{&q.byRemoteId, "select " + fileColumns + " from files where id = ?"},
+		{&q.byLocalId, "select " + fileColumns + " from files where localid = ?"},
+		{&q.parentIds, "select localparentid from parents where localid = ?"},
+	}
+	for _, s := range stmts {
+		if *s.stmt, err = db.Prepare(s.query); err != nil {
+			q.close()
+			return nil, err
+		}
+	}
+	return
+}
+
+func (q *queries) close() {
+	for _, stmt := range []*sql.Stmt{q.childWithName, q.children, q.byRemoteId, q.byLocalId, q.parentIds} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+}
+
+func (q *queries) getChildWithName(localParentId int64, name string) (*CachedDriveFile, error) {
+	return queryFile(q.childWithName, localParentId, name, OpDelete)
+}
+
+func (q *queries) getChildren(localParentId int64) ([]*CachedDriveFile, error) {
+	return queryFiles(q.children, localParentId, OpDelete)
+}
+
+func (q *queries) getByRemoteId(remoteId string) (*CachedDriveFile, error) {
+	return queryFile(q.byRemoteId, remoteId)
+}
+
+func (q *queries) getByLocalId(localId int64) (*CachedDriveFile, error) {
+	return queryFile(q.byLocalId, localId)
+}
+
+func (q *queries) getParentIds(localId int64) (parentIds []int64, err error) {
+	var rows *sql.Rows
+	if rows, err = q.parentIds.Query(localId); err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			return
+		}
+		parentIds = append(parentIds, id)
+	}
+	return parentIds, rows.Err()
+}
+
+// Gets the first file matched by stmt, nil if there are none.
+func queryFile(stmt *sql.Stmt, args ...interface{}) (*CachedDriveFile, error) {
+	files, err := queryFiles(stmt, args...)
+	if err != nil || len(files) == 0 {
+		return nil, err
+	}
+	return files[0], nil
+}
+
+func queryFiles(stmt *sql.Stmt, args ...interface{}) (files []*CachedDriveFile, err error) {
+	var rows *sql.Rows
+	if rows, err = stmt.Query(args...); err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		f := &CachedDriveFile{}
+		err = rows.Scan(&f.LocalId, &f.LocalParentId, &f.Id, &f.Name, &f.LastMod, &f.Md5Checksum,
+			&f.LastEtag, &f.FileSize, &f.IsDir, &f.LinkTarget, &f.MimeType, &f.Op)
+		if err != nil {
+			return
+		}
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
@@ -0,0 +1,96 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import (
+	"github.com/rakyll/drivefuse/third_party/github.com/coopernurse/gorp"
+)
+
+// Tx applies a batch of remote changes atomically. The metadata is
+// locked until the transaction is committed or rolled back, changes
+// are published once it's committed. Everything applied should be
+// retrieved beforehand, lookups are blocked while it's open.
+type Tx struct {
+	m       *MetaService
+	tx      *gorp.Transaction
+	changes []*Change
+}
+
+// Begins a transaction, either Commit or Rollback must be called.
+func (m *MetaService) Begin() (*Tx, error) {
+	m.mu.Lock()
+	tx, err := m.dbmap.Begin()
+	if err != nil {
+		m.mu.Unlock()
+		return nil, err
+	}
+	return &Tx{m: m, tx: tx}, nil
+}
+
+// Commits and publishes the changes.
+func (t *Tx) Commit() error {
+	err := t.tx.Commit()
+	t.m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, change := range t.changes {
+		t.m.notify(change)
+	}
+	return nil
+}
+
+// Discards the changes.
+func (t *Tx) Rollback() error {
+	err := t.tx.Rollback()
+	t.m.mu.Unlock()
+	return err
+}
+
+// Saves a file/folder's metadata as MetaService.RemoteMod does.
+func (t *Tx) RemoteMod(remoteId string, parentRemoteIds []string, data *CachedDriveFile) error {
+	change := &Change{IsRemote: true}
+	t.changes = append(t.changes, change)
+	return remoteMod(t.tx, change, remoteId, parentRemoteIds, data)
+}
+
+// Marks a file/folder as deleted as MetaService.RemoteRm does.
+func (t *Tx) RemoteRm(remoteId string) error {
+	change := &Change{IsRemote: true}
+	t.changes = append(t.changes, change)
+	return remoteRm(t.tx, change, remoteId)
+}
+
+// Gets the file or folder identified by remoteId, including
+// the uncommitted changes.
+func (t *Tx) GetByRemoteId(remoteId string) (*CachedDriveFile, error) {
+	return getByRemoteId(t.tx, remoteId)
+}
+
+// Gets the file or folder identified by localId, including
+// the uncommitted changes.
+func (t *Tx) GetByLocalId(localId int64) (*CachedDriveFile, error) {
+	return getByLocalId(t.tx, localId)
+}
+
+// Enqueues a file into the upload or download queue.
+func (t *Tx) SetOp(localId int64, op int) error {
+	return setOp(t.tx, localId, op)
+}
+
+// Persists the largest change id synchronized along with the changes.
+func (t *Tx) SaveLargestChangeId(id int64) error {
+	return saveLargestChangeId(t.tx, id)
+}
@@ -0,0 +1,365 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics provides counters, gauges and histograms that are
+// exported in the Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rakyll/drivefuse/logger"
+)
+
+// Buckets of durations in seconds, suitable for most latencies.
+var DefBuckets = []float64{.001, .005, .01, .05, .1, .5, 1, 5, 10, 30}
+
+var registry struct {
+	metrics []metric
+	mu      sync.Mutex
+}
+
+type metric interface {
+	name() string
+	write(w *bufio.Writer)
+}
+
+// Registers a metric, panics if there is one with the same name.
+func register(m metric) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	for _, other := range registry.metrics {
+		if other.name() == m.name() {
+			panic("metrics: duplicate metric " + m.name())
+		}
+	}
+	registry.metrics = append(registry.metrics, m)
+}
+
+// Writes all metrics in the Prometheus text format.
+func WriteTo(w io.Writer) error {
+	registry.mu.Lock()
+	metrics := append([]metric{}, registry.metrics...)
+	registry.mu.Unlock()
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := WriteTo(w); err != nil {
+			logger.V("error writing metrics", err)
+		}
+	})
+}
+
+// Serves the metrics at /metrics on addr until the returned
+// listener is closed.
+func Serve(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	go http.Serve(l, mux)
+	logger.V("Serving metrics on", l.Addr())
+	return l, nil
+}
+
+// desc is the name, help and label names shared by a metric's
+// series, series are keyed by their label values.
+type desc struct {
+	n      string
+	help   string
+	typ    string
+	labels []string
+
+	mu sync.Mutex
+}
+
+func (d *desc) name() string {
+	return d.n
+}
+
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", d.n, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+func (d *desc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.n, escapeHelp(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.n, d.typ)
+}
+
+// Writes a sample of the series labelled with values, extra
+// is an additional label pair such as a histogram bucket.
+func (d *desc) writeSample(w *bufio.Writer, suffix string, values []string, extra string, v float64) {
+	w.WriteString(d.n + suffix)
+	if len(values) > 0 || extra != "" {
+		pairs := make([]string, 0, len(values)+1)
+		for i, value := range values {
+			pairs = append(pairs, d.labels[i]+"=\""+escapeLabel(value)+"\"")
+		}
+		if extra != "" {
+			pairs = append(pairs, extra)
+		}
+		w.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	w.WriteString(" " + formatFloat(v) + "\n")
+}
+
+type series struct {
+	values []string
+	value  float64
+	fn     func() float64
+}
+
+// Counter is a cumulative metric that only increases.
+type Counter struct {
+	desc
+	series map[string]*series
+}
+
+// Creates and registers a counter with the given label names.
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{desc: desc{n: name, help: help, typ: "counter", labels: labels}, series: make(map[string]*series)}
+	register(c)
+	return c
+}
+
+// Increments the series labelled with values by one.
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Adds v to the series labelled with values, v must not be negative.
+func (c *Counter) Add(v float64, values ...string) {
+	if v < 0 {
+		panic("metrics: counter cannot decrease")
+	}
+	addTo(&c.desc, c.series, v, values)
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	writeSeries(&c.desc, c.series, w)
+}
+
+// Gauge is a metric that can go up and down.
+type Gauge struct {
+	desc
+	series map[string]*series
+}
+
+// Creates and registers a gauge with the given label names.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{desc: desc{n: name, help: help, typ: "gauge", labels: labels}, series: make(map[string]*series)}
+	register(g)
+	return g
+}
+
+// Sets the series labelled with values to v.
+func (g *Gauge) Set(v float64, values ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	s := g.get(values)
+	s.value, s.fn = v, nil
+}
+
+// Adds v to the series labelled with values.
+func (g *Gauge) Add(v float64, values ...string) {
+	addTo(&g.desc, g.series, v, values)
+}
+
+// Sets the series labelled with values to be computed by fn
+// each time the metrics are written.
+func (g *Gauge) SetFunc(fn func() float64, values ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.get(values).fn = fn
+}
+
+// Deletes the series labelled with values.
+func (g *Gauge) Delete(values ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.series, g.key(values))
+}
+
+func (g *Gauge) get(values []string) *series {
+	k := g.key(values)
+	s, ok := g.series[k]
+	if !ok {
+		s = &series{values: values}
+		g.series[k] = s
+	}
+	return s
+}
+
+func (g *Gauge) write(w *bufio.Writer) {
+	writeSeries(&g.desc, g.series, w)
+}
+
+// Histogram samples observations into cumulative buckets.
+type Histogram struct {
+	desc
+	buckets []float64
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	values []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Creates and registers a histogram with the given upper bounds
+// of the buckets, in increasing order.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		desc:    desc{n: name, help: help, typ: "histogram", labels: labels},
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	}
+	register(h)
+	return h
+}
+
+// Observes v for the series labelled with values.
+func (h *Histogram) Observe(v float64, values ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	k := h.key(values)
+	s, ok := h.series[k]
+	if !ok {
+		s = &histogramSeries{values: values, counts: make([]uint64, len(h.buckets))}
+		h.series[k] = s
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+// Observes the seconds elapsed since start.
+func (h *Histogram) ObserveSince(start time.Time, values ...string) {
+	h.Observe(time.Since(start).Seconds(), values...)
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.writeHeader(w)
+	for _, k := range sortedKeys(len(h.series), func(keys []string) []string {
+		for k := range h.series {
+			keys = append(keys, k)
+		}
+		return keys
+	}) {
+		s := h.series[k]
+		for i, upper := range h.buckets {
+			h.writeSample(w, "_bucket", s.values, "le=\""+formatFloat(upper)+"\"", float64(s.counts[i]))
+		}
+		h.writeSample(w, "_bucket", s.values, "le=\"+Inf\"", float64(s.count))
+		h.writeSample(w, "_sum", s.values, "", s.sum)
+		h.writeSample(w, "_count", s.values, "", float64(s.count))
+	}
+}
+
+func addTo(d *desc, m map[string]*series, v float64, values []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	k := d.key(values)
+	s, ok := m[k]
+	if !ok {
+		s = &series{values: values}
+		m[k] = s
+	}
+	s.value += v
+}
+
+func writeSeries(d *desc, m map[string]*series, w *bufio.Writer) {
+	d.mu.Lock()
+	all := make([]series, 0, len(m))
+	for _, k := range sortedKeys(len(m), func(keys []string) []string {
+		for k := range m {
+			keys = append(keys, k)
+		}
+		return keys
+	}) {
+		all = append(all, *m[k])
+	}
+	d.mu.Unlock()
+	d.writeHeader(w)
+	for _, s := range all {
+		v := s.value
+		if s.fn != nil {
+			// computed outside the lock, fn might be slow
+			v = s.fn()
+		}
+		d.writeSample(w, "", s.values, "", v)
+	}
+}
+
+func sortedKeys(n int, fill func([]string) []string) []string {
+	keys := fill(make([]string, 0, n))
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
@@ -0,0 +1,127 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	T "github.com/rakyll/drivefuse/third_party/launchpad.net/gocheck"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) {
+	T.TestingT(t)
+}
+
+type MetricsSuite struct{}
+
+var _ = T.Suite(&MetricsSuite{})
+
+// Gets the Prometheus text format of a single metric.
+func output(m metric) string {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	m.write(w)
+	w.Flush()
+	return buf.String()
+}
+
+func (s *MetricsSuite) TestCounter(c *T.C) {
+	counter := NewCounter("test_counter_total", "Test counter.", "account", "result")
+	counter.Inc("b", "ok")
+	counter.Inc("a", "miss")
+	counter.Add(2.5, "a", "miss")
+	c.Assert(output(counter), T.Equals, `# HELP test_counter_total Test counter.
+# TYPE test_counter_total counter
+test_counter_total{account="a",result="miss"} 3.5
+test_counter_total{account="b",result="ok"} 1
+`)
+	c.Assert(func() { counter.Add(-1, "a", "miss") }, T.PanicMatches, "metrics: counter cannot decrease")
+	c.Assert(func() { counter.Inc("a") }, T.PanicMatches, "metrics: test_counter_total expects 2 label values, got 1")
+}
+
+func (s *MetricsSuite) TestGauge(c *T.C) {
+	gauge := NewGauge("test_gauge", "Test gauge.", "account")
+	gauge.Set(3, "c")
+	gauge.Add(-1, "c")
+	gauge.Set(1, "b")
+	gauge.SetFunc(func() float64 { return 7 }, "a")
+	gauge.Set(5, "d")
+	gauge.Delete("d")
+	c.Assert(output(gauge), T.Equals, `# HELP test_gauge Test gauge.
+# TYPE test_gauge gauge
+test_gauge{account="a"} 7
+test_gauge{account="b"} 1
+test_gauge{account="c"} 2
+`)
+}
+
+func (s *MetricsSuite) TestGaugeWithoutLabels(c *T.C) {
+	gauge := NewGauge("test_gauge_unlabelled", "Test gauge.")
+	gauge.Set(math.Inf(1))
+	c.Assert(output(gauge), T.Equals, `# HELP test_gauge_unlabelled Test gauge.
+# TYPE test_gauge_unlabelled gauge
+test_gauge_unlabelled +Inf
+`)
+}
+
+func (s *MetricsSuite) TestHistogram(c *T.C) {
+	h := NewHistogram("test_duration_seconds", "Test histogram.", []float64{.1, 1}, "op")
+	h.Observe(.05, "read")
+	h.Observe(.5, "read")
+	h.Observe(2, "read")
+	h.Observe(1, "lookup")
+	c.Assert(output(h), T.Equals, `# HELP test_duration_seconds Test histogram.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{op="lookup",le="0.1"} 0
+test_duration_seconds_bucket{op="lookup",le="1"} 1
+test_duration_seconds_bucket{op="lookup",le="+Inf"} 1
+test_duration_seconds_sum{op="lookup"} 1
+test_duration_seconds_count{op="lookup"} 1
+test_duration_seconds_bucket{op="read",le="0.1"} 1
+test_duration_seconds_bucket{op="read",le="1"} 2
+test_duration_seconds_bucket{op="read",le="+Inf"} 3
+test_duration_seconds_sum{op="read"} 2.55
+test_duration_seconds_count{op="read"} 3
+`)
+}
+
+func (s *MetricsSuite) TestEscaping(c *T.C) {
+	counter := NewCounter("test_escaped_total", "Help with a \\ and\na new line.", "path")
+	counter.Inc("a \"quoted\" \\ path\n")
+	c.Assert(output(counter), T.Equals, `# HELP test_escaped_total Help with a \\ and\na new line.
+# TYPE test_escaped_total counter
+test_escaped_total{path="a \"quoted\" \\ path\n"} 1
+`)
+}
+
+func (s *MetricsSuite) TestRegistry(c *T.C) {
+	counter := NewCounter("test_registered_total", "Test counter.")
+	counter.Inc()
+	c.Assert(func() { NewGauge("test_registered_total", "Duplicate.") }, T.PanicMatches, "metrics: duplicate metric test_registered_total")
+
+	req, err := http.NewRequest("GET", "/metrics", nil)
+	c.Assert(err, T.IsNil)
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, req)
+	c.Assert(w.Header().Get("Content-Type"), T.Equals, "text/plain; version=0.0.4")
+	c.Assert(strings.Contains(w.Body.String(), "\ntest_registered_total 1\n"), T.Equals, true)
+}
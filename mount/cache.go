@@ -0,0 +1,139 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mount
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/rakyll/drivefuse/events"
+	"github.com/rakyll/drivefuse/metadata"
+)
+
+const (
+	// number of folders kept in memory, least recently visited
+	// ones are dropped first
+	maxCachedFolders = 1024
+)
+
+// nodeCache keeps the children of recently visited folders in memory,
+// so lookups and directory listings don't hit the metadata database.
+// A folder's entry is dropped whenever one of its children changes.
+// A file with multiple parents is listed under each of them.
+type nodeCache struct {
+	meta    *metadata.MetaService
+	folders map[int64]*list.Element
+	lru     *list.List // of *cachedFolder, most recently visited first
+	gen     uint64     // incremented on each invalidation
+
+	mu sync.Mutex
+}
+
+type cachedFolder struct {
+	localId  int64
+	children []*metadata.CachedDriveFile
+	byName   map[string]*metadata.CachedDriveFile
+}
+
+func newNodeCache(meta *metadata.MetaService) *nodeCache {
+	return &nodeCache{meta: meta, folders: make(map[int64]*list.Element), lru: list.New()}
+}
+
+// Gets the children of the folder identified by localParentId.
+func (c *nodeCache) getChildren(localParentId int64) ([]*metadata.CachedDriveFile, error) {
+	folder, err := c.get(localParentId)
+	if err != nil {
+		return nil, err
+	}
+	return folder.children, nil
+}
+
+// Looks up for the child named with name under localParentId,
+// returns nil if there is no such child.
+func (c *nodeCache) getChildWithName(localParentId int64, name string) (*metadata.CachedDriveFile, error) {
+	folder, err := c.get(localParentId)
+	if err != nil {
+		return nil, err
+	}
+	return folder.byName[name], nil
+}
+
+// Drops the folders affected by a metadata change.
+func (c *nodeCache) invalidate(change *events.Event) {
+	if !change.IsFile() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for _, id := range change.LocalParentIds {
+		c.remove(id)
+	}
+	for _, id := range change.OldLocalParentIds {
+		c.remove(id)
+	}
+}
+
+func (c *nodeCache) get(localParentId int64) (*cachedFolder, error) {
+	c.mu.Lock()
+	el, ok := c.folders[localParentId]
+	if ok {
+		c.lru.MoveToFront(el)
+	}
+	gen := c.gen
+	c.mu.Unlock()
+	if ok {
+		return el.Value.(*cachedFolder), nil
+	}
+
+	children, err := c.meta.GetChildren(localParentId)
+	if err != nil {
+		return nil, err
+	}
+	folder := &cachedFolder{
+		localId:  localParentId,
+		children: children,
+		byName:   make(map[string]*metadata.CachedDriveFile),
+	}
+	for _, item := range children {
+		if _, ok := folder.byName[item.Name]; !ok {
+			folder.byName[item.Name] = item
+		}
+	}
+	c.mu.Lock()
+	// don't cache if invalidated while loading, might be stale
+	if gen == c.gen {
+		c.add(folder)
+	}
+	c.mu.Unlock()
+	return folder, nil
+}
+
+// Caches a folder, drops the least recently visited folder if
+// there are too many.
+func (c *nodeCache) add(folder *cachedFolder) {
+	c.remove(folder.localId)
+	c.folders[folder.localId] = c.lru.PushFront(folder)
+	if c.lru.Len() > maxCachedFolders {
+		c.remove(c.lru.Back().Value.(*cachedFolder).localId)
+	}
+}
+
+func (c *nodeCache) remove(localId int64) {
+	if el, ok := c.folders[localId]; ok {
+		c.lru.Remove(el)
+		delete(c.folders, localId)
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mount
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/rakyll/drivefuse/logger"
+	"github.com/rakyll/drivefuse/metadata"
+)
+
+const (
+	nameIgnoreFile = ".drivefuseignore"
+
+	maxFolderDepth = 64
+)
+
+// Junk created by editors and operating systems, always ignored.
+var defaultIgnores = []string{
+	".DS_Store",
+	"._*",
+	"Thumbs.db",
+	"desktop.ini",
+	"*.swp",
+	"*.swx",
+	"*~",
+	"~$*",
+	".~lock.*#",
+}
+
+// ignorePattern is a line of an ignore file in gitignore syntax.
+// Patterns without a slash match names at any depth, others match
+// paths relative to the folder of the ignore file.
+type ignorePattern struct {
+	base     string // folder of the ignore file, relative to the root
+	pattern  string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// Parses gitignore styled patterns, base is the folder they
+// are relative to.
+func parseIgnores(base string, r io.Reader) (patterns []*ignorePattern) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p := &ignorePattern{base: base}
+		if strings.HasPrefix(line, "!") {
+			p.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			p.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if strings.HasPrefix(line, "**/") {
+			line = line[3:]
+		}
+		p.anchored = strings.Contains(line, "/")
+		p.pattern = strings.TrimPrefix(line, "/")
+		if p.pattern == "" {
+			continue
+		}
+		if _, err := path.Match(p.pattern, ""); err != nil {
+			logger.V("invalid ignore pattern", line)
+			continue
+		}
+		patterns = append(patterns, p)
+	}
+	return
+}
+
+// Loads the default and global ignore rules, ignoreFile
+// is optional.
+func loadIgnores(ignoreFile string) []*ignorePattern {
+	patterns := parseIgnores("", strings.NewReader(strings.Join(defaultIgnores, "\n")))
+	if ignoreFile == "" {
+		return patterns
+	}
+	f, err := os.Open(ignoreFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.V("error reading ignore file", err)
+		}
+		return patterns
+	}
+	defer f.Close()
+	return append(patterns, parseIgnores("", f)...)
+}
+
+func (p *ignorePattern) match(relPath string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	if p.base != "" {
+		if !strings.HasPrefix(relPath, p.base+"/") {
+			return false
+		}
+		relPath = relPath[len(p.base)+1:]
+	}
+	if !p.anchored {
+		relPath = path.Base(relPath)
+	}
+	ok, _ := path.Match(p.pattern, relPath)
+	return ok
+}
+
+// Tests whether the file at relPath or one of its folders is
+// ignored, the last matching pattern applies.
+func isIgnoredPath(patterns []*ignorePattern, relPath string, isDir bool) bool {
+	parts := strings.Split(relPath, "/")
+	for i := range parts {
+		p := strings.Join(parts[:i+1], "/")
+		ignored := false
+		for _, item := range patterns {
+			if item.match(p, isDir || i < len(parts)-1) {
+				ignored = !item.negate
+			}
+		}
+		if ignored {
+			return true
+		}
+	}
+	return false
+}
+
+// Tests whether a file named with name under the folder identified
+// by localParentId should be kept local-only. Folders' ignore files
+// are only applied once they are downloaded.
+func (fs *GoogleDriveFS) isIgnored(localParentId int64, name string, isDir bool) bool {
+	// collect the folders from the parent up to the root
+	var folders []*metadata.CachedDriveFile
+	for id := localParentId; id > 0 && len(folders) < maxFolderDepth; {
+		folder, err := fs.metaService.GetByLocalId(id)
+		if err != nil || folder == nil {
+			break
+		}
+		folders = append(folders, folder)
+		id = folder.LocalParentId
+	}
+	patterns := append([]*ignorePattern{}, fs.ignores...)
+	base := ""
+	for i := len(folders) - 1; i >= 0; i-- {
+		if folders[i].LocalParentId > 0 {
+			base = path.Join(base, folders[i].Name)
+		}
+		patterns = append(patterns, fs.readIgnores(folders[i].LocalId, base)...)
+	}
+	return isIgnoredPath(patterns, path.Join(base, name), isDir)
+}
+
+// Reads the ignore file in a folder from the blob cache.
+func (fs *GoogleDriveFS) readIgnores(localParentId int64, base string) []*ignorePattern {
+	file, err := fs.nodes.getChildWithName(localParentId, nameIgnoreFile)
+	if err != nil || file == nil || file.IsDir || file.Op == metadata.OpDownload || file.Op == metadata.OpFetch || file.FileSize == 0 {
+		return nil
+	}
+	data, size, err := fs.blobManager.ReadModified(file.LocalId, file.Md5Checksum, 0, int(file.FileSize))
+	if err != nil && err != io.EOF {
+		return nil
+	}
+	return parseIgnores(base, bytes.NewReader(data[:size]))
+}
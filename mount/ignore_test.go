@@ -0,0 +1,105 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mount
+
+import (
+	"strings"
+	"testing"
+
+	T "github.com/rakyll/drivefuse/third_party/launchpad.net/gocheck"
+)
+
+func Test(t *testing.T) { T.TestingT(t) }
+
+type IgnoreSuite struct{}
+
+var _ = T.Suite(&IgnoreSuite{})
+
+func parse(base string, lines ...string) []*ignorePattern {
+	return parseIgnores(base, strings.NewReader(strings.Join(lines, "\n")))
+}
+
+func (s *IgnoreSuite) TestParseIgnores(c *T.C) {
+	patterns := parse("docs",
+		"# comment",
+		"",
+		"  *.log  ",
+		"!keep.log",
+		"build/",
+		"/out",
+		"src/*.o",
+		"**/tmp",
+		"[",
+		"/",
+	)
+	c.Assert(patterns, T.HasLen, 6)
+	expected := []ignorePattern{
+		{base: "docs", pattern: "*.log"},
+		{base: "docs", pattern: "keep.log", negate: true},
+		{base: "docs", pattern: "build", dirOnly: true},
+		{base: "docs", pattern: "out", anchored: true},
+		{base: "docs", pattern: "src/*.o", anchored: true},
+		{base: "docs", pattern: "tmp"},
+	}
+	for i, p := range expected {
+		c.Assert(*patterns[i], T.DeepEquals, p)
+	}
+}
+
+var isIgnoredPathTests = []struct {
+	patterns []*ignorePattern
+	relPath  string
+	isDir    bool
+	ignored  bool
+}{
+	// names match at any depth
+	{parse("", "*.log"), "a.log", false, true},
+	{parse("", "*.log"), "a/b/c.log", false, true},
+	{parse("", "*.log"), "a.txt", false, false},
+	// the last matching pattern applies
+	{parse("", "*.log", "!keep.log"), "a/keep.log", false, false},
+	{parse("", "!keep.log", "*.log"), "a/keep.log", false, true},
+	// negation can't bring back files of an ignored folder
+	{parse("", "build/", "!build/keep"), "build/keep", false, true},
+	// anchored patterns match paths from the base
+	{parse("", "/out"), "out", true, true},
+	{parse("", "/out"), "a/out", true, false},
+	{parse("", "src/*.o"), "src/a.o", false, true},
+	{parse("", "src/*.o"), "lib/src/a.o", false, false},
+	{parse("", "**/tmp"), "a/b/tmp", false, true},
+	// dir-only patterns match folders and everything under them
+	{parse("", "build/"), "build", false, false},
+	{parse("", "build/"), "build", true, true},
+	{parse("", "build/"), "a/build/b/c.txt", false, true},
+	// per-directory patterns only apply under their folder
+	{parse("docs", "*.tmp"), "docs/a.tmp", false, true},
+	{parse("docs", "*.tmp"), "docs/x/a.tmp", false, true},
+	{parse("docs", "*.tmp"), "a.tmp", false, false},
+	{parse("docs", "*.tmp"), "docsx/a.tmp", false, false},
+	{parse("docs", "/out"), "docs/out", false, true},
+	{parse("docs", "/out"), "docs/x/out", false, false},
+	{append(parse("", "*.tmp"), parse("docs", "!a.tmp")...), "docs/a.tmp", false, false},
+	{append(parse("", "*.tmp"), parse("docs", "!a.tmp")...), "a.tmp", false, true},
+	// default rules
+	{loadIgnores(""), "a/.DS_Store", false, true},
+	{loadIgnores(""), "notes.txt~", false, true},
+	{loadIgnores(""), "notes.txt", false, false},
+}
+
+func (s *IgnoreSuite) TestIsIgnoredPath(c *T.C) {
+	for _, test := range isIgnoredPathTests {
+		c.Assert(isIgnoredPath(test.patterns, test.relPath, test.isDir), T.Equals, test.ignored, T.Commentf(test.relPath))
+	}
+}
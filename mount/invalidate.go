@@ -0,0 +1,108 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mount
+
+import (
+	"github.com/rakyll/drivefuse/events"
+	"github.com/rakyll/drivefuse/logger"
+	"github.com/rakyll/drivefuse/third_party/code.google.com/p/rsc/fuse"
+)
+
+const (
+	maxPendingInvalidations = 1024
+)
+
+// invalidator tells the kernel to drop its page, attribute and
+// directory entry caches for the files changed on the remote.
+// Notifications are sent from a separate goroutine, the kernel
+// may block them until it receives replies to pending requests.
+type invalidator struct {
+	conn    *fuse.Conn
+	changes chan *events.Event
+	done    chan struct{}
+}
+
+func newInvalidator(conn *fuse.Conn) *invalidator {
+	inv := &invalidator{
+		conn:    conn,
+		changes: make(chan *events.Event, maxPendingInvalidations),
+		done:    make(chan struct{}),
+	}
+	go inv.run()
+	return inv
+}
+
+// Stops sending notifications once the Drive is unmounted, pending
+// changes are dropped.
+func (inv *invalidator) stop() {
+	close(inv.done)
+}
+
+// Enqueues a remote change to be invalidated, local changes are
+// already known by the kernel.
+func (inv *invalidator) enqueue(change *events.Event) {
+	if !change.IsRemote || !change.IsFile() {
+		return
+	}
+	select {
+	case inv.changes <- change:
+	default:
+		// kernel will eventually drop the entries once they time out
+		logger.V("too many pending invalidations, skipping", change.LocalId)
+	}
+}
+
+func (inv *invalidator) run() {
+	for {
+		select {
+		case change := <-inv.changes:
+			inv.invalidate(change)
+		case <-inv.done:
+			return
+		}
+	}
+}
+
+func (inv *invalidator) invalidate(change *events.Event) {
+	logger.D("Invalidating kernel caches for", change.LocalId)
+	if err := inv.conn.InvalidateInode(uint64(change.LocalId), 0, 0); err != nil {
+		logger.V("error invalidating inode", change.LocalId, err)
+	}
+	renamed := change.Name != change.OldName
+	for _, id := range change.OldLocalParentIds {
+		if change.OldName != "" && (renamed || !hasId(change.LocalParentIds, id)) {
+			if err := inv.conn.InvalidateEntry(uint64(id), change.OldName); err != nil {
+				logger.V("error invalidating entry", change.OldName, err)
+			}
+		}
+	}
+	// drop negative entries cached for the new name
+	for _, id := range change.LocalParentIds {
+		if change.Name != "" && (renamed || !hasId(change.OldLocalParentIds, id)) {
+			if err := inv.conn.InvalidateEntry(uint64(id), change.Name); err != nil {
+				logger.V("error invalidating entry", change.Name, err)
+			}
+		}
+	}
+}
+
+func hasId(ids []int64, id int64) bool {
+	for _, item := range ids {
+		if item == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mount
+
+import (
+	"time"
+
+	"github.com/rakyll/drivefuse/events"
+	T "github.com/rakyll/drivefuse/third_party/launchpad.net/gocheck"
+)
+
+type InvalidateSuite struct{}
+
+var _ = T.Suite(&InvalidateSuite{})
+
+func (s *InvalidateSuite) TestEnqueue(c *T.C) {
+	inv := &invalidator{changes: make(chan *events.Event, 1)}
+	// local changes are known by the kernel
+	inv.enqueue(&events.Event{Type: events.FileChanged, LocalId: 2})
+	inv.enqueue(&events.Event{Type: events.DownloadFinished, LocalId: 2, IsRemote: true})
+	c.Assert(inv.changes, T.HasLen, 0)
+	inv.enqueue(&events.Event{Type: events.FileChanged, LocalId: 2, IsRemote: true})
+	// dropped once too many are pending
+	inv.enqueue(&events.Event{Type: events.FileChanged, LocalId: 3, IsRemote: true})
+	c.Assert(inv.changes, T.HasLen, 1)
+}
+
+func (s *InvalidateSuite) TestStop(c *T.C) {
+	inv := &invalidator{changes: make(chan *events.Event, 1), done: make(chan struct{})}
+	exited := make(chan struct{})
+	go func() {
+		inv.run()
+		close(exited)
+	}()
+	inv.stop()
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		c.Fatal("invalidator is still running once stopped")
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mount
+
+import (
+	"github.com/rakyll/drivefuse/logger"
+	"github.com/rakyll/drivefuse/metadata"
+	"github.com/rakyll/drivefuse/third_party/code.google.com/p/rsc/fuse"
+)
+
+// Adds the folder as another parent of a file, the parent is added
+// on Drive once the journal is replayed. A Drive file has the same
+// name under all of its parents, hard links can't rename.
+func (f GoogleDriveFolder) Link(req *fuse.LinkRequest, old fuse.Node, intr fuse.Intr) (fuse.Node, fuse.Error) {
+	defer f.fs.begin("link")()
+	var localId int64
+	switch n := old.(type) {
+	case *GoogleDriveFile:
+		localId = n.LocalId
+	case *GoogleDriveSymlink:
+		localId = n.LocalId
+	default:
+		return nil, fuse.EPERM
+	}
+	file, err := f.fs.metaService.GetByLocalId(localId)
+	if err != nil || file == nil || file.Op == metadata.OpLocal || file.Name != req.NewName {
+		return nil, fuse.EPERM
+	}
+	parent, err := f.fs.metaService.GetByLocalId(f.LocalId)
+	if err != nil || parent == nil || parent.Op == metadata.OpLocal {
+		// local-only folders are never synced to the remote
+		return nil, fuse.EPERM
+	}
+	if err = f.fs.metaService.LocalLink(file.LocalId, f.LocalId); err != nil {
+		logger.V("error adding parent", err)
+		return nil, fuse.EIO
+	}
+	return old, nil
+}
+
+// Removes the folder from the parents of a file that has other
+// parents, the file is kept under the other ones.
+func (fs *GoogleDriveFS) unlink(file *metadata.CachedDriveFile, localParentId int64) fuse.Error {
+	if err := fs.metaService.LocalUnlink(file.LocalId, localParentId); err != nil {
+		logger.V("error removing parent", err)
+		return fuse.EIO
+	}
+	return nil
+}
+
+// Gets the remote id of a cached file, the mounted folder is
+// cached with the root alias.
+func (fs *GoogleDriveFS) remoteIdOf(file *metadata.CachedDriveFile) string {
+	if file.Id == metadata.IdRoot {
+		return fs.rootId
+	}
+	return file.Id
+}
@@ -15,46 +15,151 @@
 package mount
 
 import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/rakyll/drivefuse/blob"
+	"github.com/rakyll/drivefuse/events"
+	"github.com/rakyll/drivefuse/logger"
 	"github.com/rakyll/drivefuse/metadata"
+	"github.com/rakyll/drivefuse/metrics"
+	"github.com/rakyll/drivefuse/third_party/code.google.com/p/goauth2/oauth"
+	client "github.com/rakyll/drivefuse/third_party/code.google.com/p/google-api-go-client/drive/v2"
 	"github.com/rakyll/drivefuse/third_party/code.google.com/p/rsc/fuse"
 )
 
 const (
 	defaultFileMod = 0774
-)
 
-var (
-	metaService *metadata.MetaService
-	blobManager *blob.Manager
+	localIdRoot = 1
 )
 
-type GoogleDriveFS struct{}
+var opLatency = metrics.NewHistogram(
+	"drivefuse_fuse_op_duration_seconds",
+	"Time taken to handle FUSE requests by operation.",
+	metrics.DefBuckets, "account", "op")
+
+// GoogleDriveFS serves a single account's Drive, each mount has
+// its own services.
+type GoogleDriveFS struct {
+	metaService   *metadata.MetaService
+	blobManager   *blob.Manager
+	remoteService *client.Service
+	httpClient    *http.Client
+	nodes         *nodeCache
+
+	// remote id of the mounted folder
+	rootId string
+
+	// global ignore rules
+	ignores []*ignorePattern
+
+	// whether to serve the items shared with the user
+	sharedWithMe bool
 
-func MountAndServe(mountPoint string, meta *metadata.MetaService, blogMngr *blob.Manager) error {
-	metaService = meta
-	blobManager = blogMngr
+	// name of the account, used to label metrics
+	account string
+
+	// requests being handled, drained once unmounted
+	inflight sync.WaitGroup
+
+	// whether the remote is unreachable
+	offline   bool
+	muOffline sync.Mutex
+
+	conn *fuse.Conn
+
+	// cancel the subscriptions to the bus and stop the
+	// invalidator once unmounted
+	unsubscribe []func()
+}
 
-	os.MkdirAll(mountPoint, defaultFileMod)
-	// try to umount first to cleanup unmounted volumes
-	Umount(mountPoint)
+// Options configures how a Drive is mounted.
+type Options struct {
+	// File ID of the mounted remote folder, root if empty.
+	RemoteId string
 
+	// Durations the kernel may cache file attributes and directory
+	// entries for, zero for the defaults.
+	AttrValid  time.Duration
+	EntryValid time.Duration
+
+	// Whether to serve the items shared with the user under
+	// a read-only folder at the root.
+	SharedWithMe bool
+
+	// Path to the global ignore file, optional.
+	IgnorePath string
+
+	// Bus metadata changes are published to.
+	Bus *events.Bus
+}
+
+// Mounts the Drive at mountPoint, requests are handled once
+// it's served.
+func Mount(mountPoint string, meta *metadata.MetaService, blogMngr *blob.Manager, t *oauth.Transport, opts *Options) (*GoogleDriveFS, error) {
+	fs := &GoogleDriveFS{
+		metaService:  meta,
+		blobManager:  blogMngr,
+		httpClient:   t.Client(),
+		nodes:        newNodeCache(meta),
+		rootId:       opts.RemoteId,
+		sharedWithMe: opts.SharedWithMe,
+		account:      opts.Bus.Account(),
+	}
+	if fs.rootId == "" {
+		fs.rootId = metadata.IdRoot
+	}
+	fs.ignores = loadIgnores(opts.IgnorePath)
+	var err error
+	if fs.remoteService, err = client.New(fs.httpClient); err != nil {
+		return nil, err
+	}
+
+	if err = Prepare(mountPoint); err != nil {
+		return nil, err
+	}
 	c, err := fuse.Mount(mountPoint)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("error mounting %s: %v", mountPoint, err)
 	}
-	c.Serve(GoogleDriveFS{})
-	return nil
+	c.AttrValid = opts.AttrValid
+	c.EntryValid = opts.EntryValid
+	fs.conn = c
+	inv := newInvalidator(c)
+	fs.unsubscribe = []func(){
+		opts.Bus.Subscribe(fs.nodes.invalidate),
+		opts.Bus.Subscribe(fs.trackConnectivity),
+		opts.Bus.Subscribe(inv.enqueue),
+		inv.stop,
+	}
+	return fs, nil
 }
 
-func (GoogleDriveFS) Root() (fuse.Node, fuse.Error) {
-	return &GoogleDriveFolder{LocalId: 1}, nil
+// Serves the mounted Drive until it's unmounted, returns once
+// the requests being handled are done.
+func (fs *GoogleDriveFS) Serve() error {
+	err := fs.conn.Serve(fs)
+	// requests might still be handled once the conn is closed
+	fs.inflight.Wait()
+	for _, cancel := range fs.unsubscribe {
+		cancel()
+	}
+	return err
+}
+
+func (fs *GoogleDriveFS) Root() (fuse.Node, fuse.Error) {
+	return &GoogleDriveFolder{fs: fs, LocalId: localIdRoot}, nil
 }
 
 type GoogleDriveFolder struct { // Note: don't change folder terminology
+	fs *GoogleDriveFS
+
 	LocalId       int64
 	LocalParentId int64
 	Name          string
@@ -63,6 +168,8 @@ type GoogleDriveFolder struct { // Note: don't change folder terminology
 }
 
 type GoogleDriveFile struct {
+	fs *GoogleDriveFS
+
 	LocalId       int64
 	LocalParentId int64
 	Name          string
@@ -73,6 +180,7 @@ type GoogleDriveFile struct {
 
 func (f GoogleDriveFolder) Attr() fuse.Attr {
 	return fuse.Attr{
+		Inode: uint64(f.LocalId),
 		Mode:  os.ModeDir | defaultFileMod,
 		Uid:   uint32(os.Getuid()),
 		Gid:   uint32(os.Getgid()),
@@ -81,103 +189,177 @@ func (f GoogleDriveFolder) Attr() fuse.Attr {
 }
 
 func (f GoogleDriveFolder) Lookup(name string, intr fuse.Intr) (fuse.Node, fuse.Error) {
+	defer f.fs.begin("lookup")()
 	switch name {
 	// ignore some MacOSX lookups
 	case "._.", ".hidden", ".DS_Store", "mach_kernel", "Backups.backupdb":
 		return nil, fuse.ENOENT
 	}
+	if f.LocalId == localIdRoot && name == nameTrashDir {
+		return &TrashFolder{fs: f.fs}, nil
+	}
+	if f.LocalId == localIdRoot && name == nameSharedDir && f.fs.sharedWithMe {
+		return &SharedFolder{fs: f.fs}, nil
+	}
 
-	file, err := metaService.GetChildrenWithName(f.LocalId, name)
+	file, err := f.fs.nodes.getChildWithName(f.LocalId, name)
+	if err == nil && file == nil {
+		if revs := f.fs.lookupRevisionsFolder(f.LocalId, name); revs != nil {
+			return revs, nil
+		}
+	}
 	if err != nil || file == nil {
 		return nil, fuse.ENOENT
 	}
 	if file.IsDir {
-		return convertToDirNode(file), nil
+		return f.fs.convertToDirNode(file), nil
+	}
+	if file.LinkTarget != "" {
+		return f.fs.convertToSymlinkNode(file), nil
 	}
-	return convertToFileNode(file), nil
+	return f.fs.convertToFileNode(file), nil
 }
 
 func (f GoogleDriveFolder) Mkdir(req *fuse.MkdirRequest, intr fuse.Intr) (fuse.Node, fuse.Error) {
-	file, err := metaService.LocalCreate(f.LocalId, req.Name, 0, true)
+	defer f.fs.begin("mkdir")()
+	isLocal := f.fs.isIgnored(f.LocalId, req.Name, true)
+	file, err := f.fs.metaService.LocalCreate(f.LocalId, req.Name, 0, true, isLocal)
 	if err != nil {
 		return nil, fuse.ENOENT
 	}
-	return convertToDirNode(file), nil
+	return f.fs.convertToDirNode(file), nil
 }
 
 func (f GoogleDriveFolder) Create(req *fuse.CreateRequest, res *fuse.CreateResponse, intr fuse.Intr) (fuse.Node, fuse.Handle, fuse.Error) {
-	file, err := metaService.LocalCreate(f.LocalId, req.Name, 0, false)
+	defer f.fs.begin("create")()
+	isLocal := f.fs.isIgnored(f.LocalId, req.Name, false)
+	file, err := f.fs.metaService.LocalCreate(f.LocalId, req.Name, 0, false, isLocal)
 	if err != nil {
 		return nil, nil, fuse.ENOENT
 	}
-	return convertToFileNode(file), nil, nil
+	return f.fs.convertToFileNode(file), nil, nil
 }
 
 func (f GoogleDriveFolder) ReadDir(intr fuse.Intr) ([]fuse.Dirent, fuse.Error) {
+	defer f.fs.begin("readdir")()
 	// TODO: handle files with same names under a directory
 	ents := []fuse.Dirent{}
-	children, _ := metaService.GetChildren(f.LocalId)
+	children, _ := f.fs.nodes.getChildren(f.LocalId)
 	for _, item := range children {
-		ents = append(ents, fuse.Dirent{Name: item.Name})
+		ents = append(ents, fuse.Dirent{Inode: uint64(item.LocalId), Name: item.Name})
+	}
+	if f.LocalId == localIdRoot {
+		ents = append(ents, fuse.Dirent{Name: nameTrashDir})
+		if f.fs.sharedWithMe {
+			ents = append(ents, fuse.Dirent{Name: nameSharedDir})
+		}
 	}
 	return ents, nil
 }
 
 func (f GoogleDriveFolder) Rename(req *fuse.RenameRequest, newDir fuse.Node, intr fuse.Intr) fuse.Error {
+	defer f.fs.begin("rename")()
 	// TODO: handle files with same names under a directory
-	dir := newDir.(*GoogleDriveFolder)
-	if err := metaService.LocalMod(f.LocalId, req.OldName, dir.LocalId, req.NewName, -1); err != nil {
+	dir, ok := newDir.(*GoogleDriveFolder)
+	if !ok {
+		return fuse.EPERM
+	}
+	// TODO: update the children of renamed folders
+	file, err := f.fs.nodes.getChildWithName(f.LocalId, req.OldName)
+	if err != nil {
+		return fuse.EIO
+	}
+	// files already on the remote keep syncing once ignored
+	isLocal := false
+	if file == nil || file.Id == "" {
+		isLocal = f.fs.isIgnored(dir.LocalId, req.NewName, file != nil && file.IsDir)
+	}
+	if err := f.fs.metaService.LocalMod(f.LocalId, req.OldName, dir.LocalId, req.NewName, -1, isLocal); err != nil {
 		return fuse.EIO
 	}
 	return nil
 }
 
 func (f GoogleDriveFolder) Remove(req *fuse.RemoveRequest, intr fuse.Intr) fuse.Error {
+	defer f.fs.begin("remove")()
 	// TODO: handle files with same names under a directory
-	if err := metaService.LocalRm(f.LocalId, req.Name, req.Dir); err != nil {
+	file, err := f.fs.nodes.getChildWithName(f.LocalId, req.Name)
+	if err == nil && file != nil && !file.IsDir {
+		// unlink if the file is still listed under other folders
+		if parentIds, err := f.fs.metaService.GetParentIds(file.LocalId); err == nil && len(parentIds) > 1 {
+			return f.fs.unlink(file, f.LocalId)
+		}
+	}
+	if err := f.fs.metaService.LocalRm(f.LocalId, req.Name, req.Dir); err != nil {
 		return fuse.EIO
 	}
 	return nil
 }
 
 func (f GoogleDriveFile) Attr() fuse.Attr {
+	size, lastMod := f.Size, f.LastMod
+	// might be written since it's looked up
+	if file, _ := f.fs.metaService.GetByLocalId(f.LocalId); file != nil {
+		size, lastMod = file.FileSize, file.LastMod
+	}
 	return fuse.Attr{
-		Mode:  0400,
+		Inode: uint64(f.LocalId),
+		Mode:  0600,
 		Uid:   uint32(os.Getuid()),
 		Gid:   uint32(os.Getgid()),
-		Size:  uint64(f.Size),
-		Mtime: f.LastMod,
+		Size:  uint64(size),
+		Mtime: lastMod,
 	}
 }
 
 func (f GoogleDriveFile) Write(req *fuse.WriteRequest, res *fuse.WriteResponse, intr fuse.Intr) fuse.Error {
-	// blob manager and metadata only
-	panic("not implemented")
+	defer f.fs.begin("write")()
+	if err := f.fs.write(f.LocalId, f.Name, req.Data, req.Offset, false); err != nil {
+		return err
+	}
+	res.Size = len(req.Data)
 	return nil
 }
 
+// Replaces the contents of a file truncated when it's opened.
+func (f GoogleDriveFile) WriteAll(data []byte, intr fuse.Intr) fuse.Error {
+	defer f.fs.begin("write")()
+	return f.fs.write(f.LocalId, f.Name, data, 0, true)
+}
+
 func (f GoogleDriveFile) Read(req *fuse.ReadRequest, res *fuse.ReadResponse, intr fuse.Intr) fuse.Error {
-	var blob []byte
-	var err error
-	if blob, _, err = blobManager.Read(f.LocalId, f.Md5Checksum, req.Offset, req.Size); err != nil {
+	defer f.fs.begin("read")()
+	blob, n, err := f.fs.blobManager.ReadModified(f.LocalId, f.Md5Checksum, req.Offset, req.Size)
+	if os.IsNotExist(err) {
+		// contents might be downloaded or uploaded since it's looked up
+		if file, _ := f.fs.metaService.GetByLocalId(f.LocalId); file != nil && file.Md5Checksum != f.Md5Checksum {
+			blob, n, err = f.fs.blobManager.Read(f.LocalId, file.Md5Checksum, req.Offset, req.Size)
+		}
+	}
+	if os.IsNotExist(err) {
 		// TODO: add a loading icon and etc
-		// TODO: force add the file to the download queue
-		return nil
+		return f.fs.readMiss(f.LocalId, f.Name)
+	}
+	if err != nil && err != io.EOF {
+		logger.V("error reading", f.Name, err)
+		return fuse.EIO
 	}
-	res.Data = blob
+	res.Data = blob[:n]
 	return nil
 }
 
-func convertToDirNode(file *metadata.CachedDriveFile) *GoogleDriveFolder {
+func (fs *GoogleDriveFS) convertToDirNode(file *metadata.CachedDriveFile) *GoogleDriveFolder {
 	return &GoogleDriveFolder{
+		fs:            fs,
 		LocalId:       file.LocalId,
 		LocalParentId: file.LocalParentId,
 		Name:          file.Name,
 		LastMod:       file.LastMod}
 }
 
-func convertToFileNode(file *metadata.CachedDriveFile) *GoogleDriveFile {
+func (fs *GoogleDriveFS) convertToFileNode(file *metadata.CachedDriveFile) *GoogleDriveFile {
 	return &GoogleDriveFile{
+		fs:            fs,
 		LocalId:       file.LocalId,
 		LocalParentId: file.LocalParentId,
 		Name:          file.Name,
@@ -186,4 +368,84 @@ func convertToFileNode(file *metadata.CachedDriveFile) *GoogleDriveFile {
 		LastMod:       file.LastMod}
 }
 
+// Tracks a request being handled, the returned function must be
+// called once it's done. Records the time taken to handle it.
+func (fs *GoogleDriveFS) begin(op string) func() {
+	fs.inflight.Add(1)
+	start := time.Now()
+	return func() {
+		opLatency.ObserveSince(start, fs.account, op)
+		fs.inflight.Done()
+	}
+}
+
+// Writes data at offset to the cached contents of a file, the
+// contents are replaced if truncate is set. Modified contents are
+// queued for upload. Files that are not cached are queued for
+// download, they can be written once downloaded.
+func (fs *GoogleDriveFS) write(localId int64, name string, data []byte, offset int64, truncate bool) fuse.Error {
+	file, err := fs.metaService.GetByLocalId(localId)
+	if err != nil || file == nil {
+		return fuse.ENOENT
+	}
+	// written contents are kept apart until they are uploaded
+	if err = fs.blobManager.Modify(file.LocalId, file.Md5Checksum, truncate || file.FileSize == 0); err == nil {
+		var size int64
+		if size, err = fs.blobManager.WriteAt(file.LocalId, blob.LocalChecksum, data, offset); err == nil {
+			err = fs.metaService.LocalWrite(file.LocalId, size)
+		}
+	}
+	if os.IsNotExist(err) && file.Id != "" {
+		return fs.readMiss(localId, name)
+	}
+	if err != nil {
+		logger.V("error writing", name, err)
+		return fuse.EIO
+	}
+	return nil
+}
+
+// Downloads size bytes at offset of a file that is not cached,
+// only the range is requested.
+func (fs *GoogleDriveFS) downloadRange(downloadUrl string, offset int64, size int) ([]byte, fuse.Error) {
+	if fs.isOffline() {
+		return nil, fuse.EIO
+	}
+	req, err := http.NewRequest("GET", downloadUrl, nil)
+	if err != nil {
+		return nil, fuse.EIO
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+int64(size)-1))
+	resp, err := fs.httpClient.Do(req)
+	if err != nil {
+		logger.V("error downloading", err)
+		return nil, fuse.EIO
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// read past the end
+		return nil, nil
+	case resp.StatusCode == http.StatusOK:
+		// range is ignored, skip to the offset
+		if _, err = io.CopyN(ioutil.Discard, resp.Body, offset); err == io.EOF {
+			return nil, nil
+		}
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		logger.V("error downloading [not ok]", resp.StatusCode)
+		return nil, fuse.EIO
+	}
+	if err != nil {
+		logger.V("error downloading", err)
+		return nil, fuse.EIO
+	}
+	data := make([]byte, size)
+	n, err := io.ReadFull(resp.Body, data)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		logger.V("error downloading", err)
+		return nil, fuse.EIO
+	}
+	return data[:n], nil
+}
+
 // TODO(burcud): implement write, release, truncate
@@ -0,0 +1,68 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mount
+
+import (
+	"errors"
+
+	"github.com/rakyll/drivefuse/events"
+	"github.com/rakyll/drivefuse/logger"
+	"github.com/rakyll/drivefuse/metadata"
+	"github.com/rakyll/drivefuse/third_party/code.google.com/p/rsc/fuse"
+)
+
+// Returned by the operations that need the remote while it's
+// unreachable.
+var errOffline = errors.New("remote is unreachable")
+
+// Tracks the connectivity reported by the syncer. Operations
+// that need the remote fail right away while offline, rather
+// than waiting for the requests to time out.
+func (fs *GoogleDriveFS) trackConnectivity(e *events.Event) {
+	switch e.Type {
+	case events.Offline, events.Online:
+		fs.muOffline.Lock()
+		fs.offline = e.Type == events.Offline
+		fs.muOffline.Unlock()
+	}
+}
+
+func (fs *GoogleDriveFS) isOffline() bool {
+	fs.muOffline.Lock()
+	defer fs.muOffline.Unlock()
+	return fs.offline
+}
+
+// Handles a read or write of a file that is not cached. The file is
+// queued to be downloaded unless the remote is unreachable, it's
+// served once downloaded. Local files have no contents yet.
+func (fs *GoogleDriveFS) readMiss(localId int64, name string) fuse.Error {
+	file, err := fs.metaService.GetByLocalId(localId)
+	if err != nil || file == nil {
+		return fuse.ENOENT
+	}
+	if file.Id == "" {
+		return nil
+	}
+	if fs.isOffline() {
+		logger.V("can't access", name, "[not cached, offline]")
+		return fuse.EIO
+	}
+	if file.Op == metadata.OpNone {
+		fs.metaService.SetOp(localId, metadata.OpFetch)
+	}
+	logger.V("can't access", name, "[not cached, queued to download]")
+	return fuse.EIO
+}
@@ -0,0 +1,153 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mount
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rakyll/drivefuse/logger"
+	client "github.com/rakyll/drivefuse/third_party/code.google.com/p/google-api-go-client/drive/v2"
+	"github.com/rakyll/drivefuse/third_party/code.google.com/p/rsc/fuse"
+)
+
+const (
+	suffixRevisionsDir = "@revisions"
+
+	layoutRevisionName = "2006-01-02T15:04:05Z"
+)
+
+// RevisionsFolder is a hidden virtual folder, named as the file name
+// suffixed with @revisions, that lists the revisions of a Drive file.
+// It's not listed by its parent, it's only reachable by a lookup.
+type RevisionsFolder struct {
+	fs *GoogleDriveFS
+
+	RemoteId string
+	Name     string
+	LastMod  time.Time
+}
+
+// RevisionFile is a read-only revision of a Drive file. Its contents
+// are downloaded in ranges as the revision is read, they are not
+// cached.
+type RevisionFile struct {
+	fs *GoogleDriveFS
+
+	DownloadUrl string
+	Size        int64
+	LastMod     time.Time
+}
+
+func (f RevisionsFolder) Attr() fuse.Attr {
+	return fuse.Attr{
+		Mode:  os.ModeDir | 0500,
+		Uid:   uint32(os.Getuid()),
+		Gid:   uint32(os.Getgid()),
+		Mtime: f.LastMod,
+	}
+}
+
+func (f RevisionsFolder) Lookup(name string, intr fuse.Intr) (fuse.Node, fuse.Error) {
+	defer f.fs.begin("revisions-lookup")()
+	revs, err := f.fs.listRevisions(f.RemoteId)
+	if err != nil {
+		return nil, fuse.EIO
+	}
+	for _, item := range revs {
+		if revisionName(f.Name, item) == name {
+			return f.fs.convertToRevisionNode(item), nil
+		}
+	}
+	return nil, fuse.ENOENT
+}
+
+func (f RevisionsFolder) ReadDir(intr fuse.Intr) ([]fuse.Dirent, fuse.Error) {
+	defer f.fs.begin("revisions-readdir")()
+	revs, err := f.fs.listRevisions(f.RemoteId)
+	if err != nil {
+		return nil, fuse.EIO
+	}
+	ents := []fuse.Dirent{}
+	for _, item := range revs {
+		ents = append(ents, fuse.Dirent{Name: revisionName(f.Name, item)})
+	}
+	return ents, nil
+}
+
+func (f RevisionFile) Attr() fuse.Attr {
+	return fuse.Attr{
+		Mode:  0400,
+		Uid:   uint32(os.Getuid()),
+		Gid:   uint32(os.Getgid()),
+		Size:  uint64(f.Size),
+		Mtime: f.LastMod,
+	}
+}
+
+func (f RevisionFile) Read(req *fuse.ReadRequest, res *fuse.ReadResponse, intr fuse.Intr) (err fuse.Error) {
+	defer f.fs.begin("revision-read")()
+	res.Data, err = f.fs.downloadRange(f.DownloadUrl, req.Offset, req.Size)
+	return
+}
+
+// Looks up for the revisions folder of a file, returns nil if
+// name is not a revisions folder name.
+func (fs *GoogleDriveFS) lookupRevisionsFolder(localParentId int64, name string) *RevisionsFolder {
+	if !strings.HasSuffix(name, suffixRevisionsDir) {
+		return nil
+	}
+	fileName := strings.TrimSuffix(name, suffixRevisionsDir)
+	file, err := fs.nodes.getChildWithName(localParentId, fileName)
+	if err != nil || file == nil || file.IsDir || file.Id == "" {
+		return nil
+	}
+	return &RevisionsFolder{fs: fs, RemoteId: file.Id, Name: file.Name, LastMod: file.LastMod}
+}
+
+// Lists the downloadable revisions of a file, Google Docs
+// revisions can only be exported and are skipped.
+func (fs *GoogleDriveFS) listRevisions(remoteId string) (revs []*client.Revision, err error) {
+	if fs.isOffline() {
+		return nil, errOffline
+	}
+	var list *client.RevisionList
+	if list, err = fs.remoteService.Revisions.List(remoteId).Do(); err != nil {
+		logger.V("error listing revisions", remoteId, err)
+		return
+	}
+	for _, item := range list.Items {
+		if item.DownloadUrl != "" {
+			revs = append(revs, item)
+		}
+	}
+	return
+}
+
+func revisionName(fileName string, rev *client.Revision) string {
+	lastMod, _ := time.Parse(layoutDateTime, rev.ModifiedDate)
+	return lastMod.UTC().Format(layoutRevisionName) + "_" + fileName
+}
+
+func (fs *GoogleDriveFS) convertToRevisionNode(rev *client.Revision) *RevisionFile {
+	lastMod, _ := time.Parse(layoutDateTime, rev.ModifiedDate)
+	return &RevisionFile{
+		fs:          fs,
+		DownloadUrl: rev.DownloadUrl,
+		Size:        rev.FileSize,
+		LastMod:     lastMod,
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mount
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/rakyll/drivefuse/logger"
+	"github.com/rakyll/drivefuse/metadata"
+	client "github.com/rakyll/drivefuse/third_party/code.google.com/p/google-api-go-client/drive/v2"
+	"github.com/rakyll/drivefuse/third_party/code.google.com/p/rsc/fuse"
+)
+
+const (
+	nameSharedDir = "Shared with me"
+
+	querySharedWithMe = "sharedWithMe and trashed=false"
+	queryChildren     = "'%s' in parents and trashed=false"
+)
+
+// SharedFolder is a read-only virtual folder that lists the items
+// shared with the user that are not added to their Drive. The folder
+// at the mount root lists the shared items, its subfolders list the
+// children of shared folders. Shared items are not cached.
+type SharedFolder struct {
+	fs *GoogleDriveFS
+
+	RemoteId string // empty for the top-level folder
+	LastMod  time.Time
+}
+
+// SharedFile is a read-only file shared with the user. Its contents
+// are downloaded in ranges as the file is read, they are not cached.
+type SharedFile struct {
+	fs *GoogleDriveFS
+
+	DownloadUrl string
+	Size        int64
+	LastMod     time.Time
+}
+
+func (f SharedFolder) Attr() fuse.Attr {
+	return fuse.Attr{
+		Mode:  os.ModeDir | 0500,
+		Uid:   uint32(os.Getuid()),
+		Gid:   uint32(os.Getgid()),
+		Mtime: f.LastMod,
+	}
+}
+
+func (f SharedFolder) Lookup(name string, intr fuse.Intr) (fuse.Node, fuse.Error) {
+	defer f.fs.begin("shared-lookup")()
+	files, err := f.fs.listShared(f.RemoteId)
+	if err != nil {
+		return nil, fuse.EIO
+	}
+	for _, item := range files {
+		if item.Title == name {
+			return f.fs.convertToSharedNode(item), nil
+		}
+	}
+	return nil, fuse.ENOENT
+}
+
+func (f SharedFolder) ReadDir(intr fuse.Intr) ([]fuse.Dirent, fuse.Error) {
+	defer f.fs.begin("shared-readdir")()
+	// TODO: handle files with same names under a shared folder
+	files, err := f.fs.listShared(f.RemoteId)
+	if err != nil {
+		return nil, fuse.EIO
+	}
+	ents := []fuse.Dirent{}
+	for _, item := range files {
+		ents = append(ents, fuse.Dirent{Name: item.Title})
+	}
+	return ents, nil
+}
+
+func (f SharedFile) Attr() fuse.Attr {
+	return fuse.Attr{
+		Mode:  0400,
+		Uid:   uint32(os.Getuid()),
+		Gid:   uint32(os.Getgid()),
+		Size:  uint64(f.Size),
+		Mtime: f.LastMod,
+	}
+}
+
+func (f SharedFile) Read(req *fuse.ReadRequest, res *fuse.ReadResponse, intr fuse.Intr) (err fuse.Error) {
+	defer f.fs.begin("shared-read")()
+	res.Data, err = f.fs.downloadRange(f.DownloadUrl, req.Offset, req.Size)
+	return
+}
+
+// Lists the items shared with the user if remoteId is empty,
+// otherwise the children of the shared folder identified by
+// remoteId. Google Docs are skipped, they can only be exported.
+func (fs *GoogleDriveFS) listShared(remoteId string) (files []*client.File, err error) {
+	if fs.isOffline() {
+		return nil, errOffline
+	}
+	q := querySharedWithMe
+	if remoteId != "" {
+		q = fmt.Sprintf(queryChildren, remoteId)
+	}
+	pageToken := ""
+	for {
+		req := fs.remoteService.Files.List().Q(q)
+		if pageToken != "" {
+			req.PageToken(pageToken)
+		}
+		var list *client.FileList
+		if list, err = req.Do(); err != nil {
+			logger.V("error listing shared items", err)
+			return
+		}
+		for _, item := range list.Items {
+			if item.DownloadUrl == "" && item.MimeType != metadata.MimeTypeFolder {
+				continue
+			}
+			files = append(files, item)
+		}
+		if pageToken = list.NextPageToken; pageToken == "" {
+			return
+		}
+	}
+}
+
+func (fs *GoogleDriveFS) convertToSharedNode(file *client.File) fuse.Node {
+	lastMod, _ := time.Parse(layoutDateTime, file.ModifiedDate)
+	if file.MimeType == metadata.MimeTypeFolder {
+		return &SharedFolder{fs: fs, RemoteId: file.Id, LastMod: lastMod}
+	}
+	return &SharedFile{
+		fs:          fs,
+		DownloadUrl: file.DownloadUrl,
+		Size:        file.FileSize,
+		LastMod:     lastMod,
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mount
+
+import (
+	"os"
+	"time"
+
+	"github.com/rakyll/drivefuse/logger"
+	"github.com/rakyll/drivefuse/metadata"
+	"github.com/rakyll/drivefuse/third_party/code.google.com/p/rsc/fuse"
+)
+
+// GoogleDriveSymlink is a symbolic link. Symlinks are stored on Drive
+// as small files containing the target path, tagged with a public
+// property so that other drivefuse clients render them as symlinks.
+type GoogleDriveSymlink struct {
+	fs *GoogleDriveFS
+
+	LocalId       int64
+	LocalParentId int64
+	Name          string
+	Target        string
+	LastMod       time.Time
+}
+
+func (f GoogleDriveSymlink) Attr() fuse.Attr {
+	return fuse.Attr{
+		Inode: uint64(f.LocalId),
+		Mode:  os.ModeSymlink | 0777,
+		Uid:   uint32(os.Getuid()),
+		Gid:   uint32(os.Getgid()),
+		Size:  uint64(len(f.Target)),
+		Mtime: f.LastMod,
+	}
+}
+
+func (f GoogleDriveSymlink) Readlink(req *fuse.ReadlinkRequest, intr fuse.Intr) (string, fuse.Error) {
+	defer f.fs.begin("readlink")()
+	return f.Target, nil
+}
+
+// Caches the symlink, it's created on Drive once the journal is
+// replayed.
+func (f GoogleDriveFolder) Symlink(req *fuse.SymlinkRequest, intr fuse.Intr) (fuse.Node, fuse.Error) {
+	defer f.fs.begin("symlink")()
+	isLocal := f.fs.isIgnored(f.LocalId, req.NewName, false)
+	file, err := f.fs.metaService.LocalSymlink(f.LocalId, req.NewName, req.Target, isLocal)
+	if err != nil {
+		logger.V("error creating symlink", err)
+		return nil, fuse.EIO
+	}
+	return f.fs.convertToSymlinkNode(file), nil
+}
+
+func (fs *GoogleDriveFS) convertToSymlinkNode(file *metadata.CachedDriveFile) *GoogleDriveSymlink {
+	return &GoogleDriveSymlink{
+		fs:            fs,
+		LocalId:       file.LocalId,
+		LocalParentId: file.LocalParentId,
+		Name:          file.Name,
+		Target:        file.LinkTarget,
+		LastMod:       file.LastMod}
+}
@@ -0,0 +1,281 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mount
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rakyll/drivefuse/logger"
+	"github.com/rakyll/drivefuse/metadata"
+	client "github.com/rakyll/drivefuse/third_party/code.google.com/p/google-api-go-client/drive/v2"
+	"github.com/rakyll/drivefuse/third_party/code.google.com/p/rsc/fuse"
+)
+
+const (
+	nameTrashDir = ".trash"
+
+	queryTrashed   = "trashed=true"
+	queryTrashedAs = "title = '%s' and trashed=true"
+	queryTrashedIn = "'%s' in parents and trashed=true"
+	layoutDateTime = "2006-01-02T15:04:05.000Z"
+)
+
+// TrashFolder is a virtual folder at the mount root that lists the
+// items in the Drive trash. Moving an entry out of it restores the
+// item, removing an entry from it deletes the item permanently.
+type TrashFolder struct {
+	fs *GoogleDriveFS
+}
+
+// TrashedFile represents a trashed Drive file or folder. Trashed
+// items are not cached, only their attributes are served. Trashed
+// folders list their trashed children.
+type TrashedFile struct {
+	fs *GoogleDriveFS
+
+	Id      string
+	Name    string
+	Size    int64
+	IsDir   bool
+	LastMod time.Time
+}
+
+func (f TrashFolder) Attr() fuse.Attr {
+	return fuse.Attr{
+		Mode: os.ModeDir | defaultFileMod,
+		Uid:  uint32(os.Getuid()),
+		Gid:  uint32(os.Getgid()),
+	}
+}
+
+func (f TrashFolder) Lookup(name string, intr fuse.Intr) (fuse.Node, fuse.Error) {
+	defer f.fs.begin("trash-lookup")()
+	file, err := f.fs.lookupTrashed(name)
+	if err != nil {
+		return nil, fuse.EIO
+	}
+	if file == nil {
+		return nil, fuse.ENOENT
+	}
+	return f.fs.convertToTrashedNode(file), nil
+}
+
+func (f TrashFolder) ReadDir(intr fuse.Intr) ([]fuse.Dirent, fuse.Error) {
+	defer f.fs.begin("trash-readdir")()
+	// TODO: handle files with same names in the trash
+	files, err := f.fs.listTrashed()
+	if err != nil {
+		return nil, fuse.EIO
+	}
+	ents := []fuse.Dirent{}
+	for _, item := range files {
+		ents = append(ents, fuse.Dirent{Name: item.Title})
+	}
+	return ents, nil
+}
+
+// Restores the trashed item. If the item is moved into a folder other
+// than its original parent or renamed, it's patched accordingly.
+func (f TrashFolder) Rename(req *fuse.RenameRequest, newDir fuse.Node, intr fuse.Intr) fuse.Error {
+	defer f.fs.begin("trash-rename")()
+	dir, ok := newDir.(*GoogleDriveFolder)
+	if !ok {
+		return fuse.EPERM
+	}
+	parent, err := f.fs.metaService.GetByLocalId(dir.LocalId)
+	if err != nil || parent == nil || parent.Id == "" {
+		// parent is not synced to the remote yet
+		return fuse.EPERM
+	}
+	file, err := f.fs.lookupTrashed(req.OldName)
+	if err != nil {
+		return fuse.EIO
+	}
+	if file == nil {
+		return fuse.ENOENT
+	}
+	logger.V("Restoring from trash", file.Id)
+	if file, err = f.fs.remoteService.Files.Untrash(file.Id).Do(); err != nil {
+		logger.V("error restoring", err)
+		return fuse.EIO
+	}
+	parentId := f.fs.remoteIdOf(parent)
+	if file.Title == req.NewName && hasParent(file, parentId) {
+		return nil
+	}
+	patch := &client.File{
+		Title:   req.NewName,
+		Parents: []*client.ParentReference{&client.ParentReference{Id: parentId}},
+	}
+	if _, err = f.fs.remoteService.Files.Patch(file.Id, patch).Do(); err != nil {
+		logger.V("error moving restored item", err)
+		return fuse.EIO
+	}
+	return nil
+}
+
+// Permanently deletes the trashed item.
+func (f TrashFolder) Remove(req *fuse.RemoveRequest, intr fuse.Intr) fuse.Error {
+	defer f.fs.begin("trash-remove")()
+	file, err := f.fs.lookupTrashed(req.Name)
+	if err != nil {
+		return fuse.EIO
+	}
+	if file == nil {
+		return fuse.ENOENT
+	}
+	logger.V("Deleting permanently", file.Id)
+	if err = f.fs.remoteService.Files.Delete(file.Id).Do(); err != nil {
+		logger.V("error deleting", err)
+		return fuse.EIO
+	}
+	return nil
+}
+
+func (f TrashedFile) Attr() fuse.Attr {
+	mode := os.FileMode(0400)
+	if f.IsDir {
+		mode = os.ModeDir | 0500
+	}
+	return fuse.Attr{
+		Mode:  mode,
+		Uid:   uint32(os.Getuid()),
+		Gid:   uint32(os.Getgid()),
+		Size:  uint64(f.Size),
+		Mtime: f.LastMod,
+	}
+}
+
+func (f TrashedFile) Lookup(name string, intr fuse.Intr) (fuse.Node, fuse.Error) {
+	defer f.fs.begin("trash-lookup")()
+	if !f.IsDir {
+		return nil, fuse.ENOENT
+	}
+	files, err := f.fs.listTrashedIn(f.Id)
+	if err != nil {
+		return nil, fuse.EIO
+	}
+	for _, item := range files {
+		if item.Title == name {
+			return f.fs.convertToTrashedNode(item), nil
+		}
+	}
+	return nil, fuse.ENOENT
+}
+
+func (f TrashedFile) ReadDir(intr fuse.Intr) ([]fuse.Dirent, fuse.Error) {
+	defer f.fs.begin("trash-readdir")()
+	// TODO: handle files with same names under a trashed folder
+	if !f.IsDir {
+		return nil, fuse.ENOENT
+	}
+	files, err := f.fs.listTrashedIn(f.Id)
+	if err != nil {
+		return nil, fuse.EIO
+	}
+	ents := []fuse.Dirent{}
+	for _, item := range files {
+		ents = append(ents, fuse.Dirent{Name: item.Title})
+	}
+	return ents, nil
+}
+
+// Lists the explicitly trashed items, children of a trashed
+// folder are not listed.
+func (fs *GoogleDriveFS) listTrashed() (files []*client.File, err error) {
+	return fs.queryTrashed(queryTrashed, true)
+}
+
+// Lists the trashed children of the trashed folder identified by
+// remoteId, the ones trashed along with the folder included.
+func (fs *GoogleDriveFS) listTrashedIn(remoteId string) (files []*client.File, err error) {
+	return fs.queryTrashed(fmt.Sprintf(queryTrashedIn, escapeQuery(remoteId)), false)
+}
+
+// Lists the trashed items matching the query, only the explicitly
+// trashed ones if explicit is set.
+func (fs *GoogleDriveFS) queryTrashed(q string, explicit bool) (files []*client.File, err error) {
+	if fs.isOffline() {
+		return nil, errOffline
+	}
+	pageToken := ""
+	for {
+		req := fs.remoteService.Files.List().Q(q)
+		if pageToken != "" {
+			req.PageToken(pageToken)
+		}
+		var list *client.FileList
+		if list, err = req.Do(); err != nil {
+			logger.V("error listing trash", err)
+			return
+		}
+		for _, item := range list.Items {
+			if explicit && !item.ExplicitlyTrashed {
+				continue
+			}
+			if item.DownloadUrl == "" && item.MimeType != metadata.MimeTypeFolder {
+				continue
+			}
+			files = append(files, item)
+		}
+		if pageToken = list.NextPageToken; pageToken == "" {
+			return
+		}
+	}
+}
+
+// Looks up for the trashed item named with name, only the items
+// with the name are listed.
+func (fs *GoogleDriveFS) lookupTrashed(name string) (*client.File, error) {
+	files, err := fs.queryTrashed(fmt.Sprintf(queryTrashedAs, escapeQuery(name)), true)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range files {
+		if item.Title == name {
+			return item, nil
+		}
+	}
+	return nil, nil
+}
+
+// Escapes a value quoted in a search query.
+func escapeQuery(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value)
+}
+
+func hasParent(file *client.File, parentId string) bool {
+	for _, p := range file.Parents {
+		if p.Id == parentId || (p.IsRoot && parentId == metadata.IdRoot) {
+			return true
+		}
+	}
+	return false
+}
+
+func (fs *GoogleDriveFS) convertToTrashedNode(file *client.File) *TrashedFile {
+	lastMod, _ := time.Parse(layoutDateTime, file.ModifiedDate)
+	return &TrashedFile{
+		fs:      fs,
+		Id:      file.Id,
+		Name:    file.Title,
+		Size:    file.FileSize,
+		IsDir:   file.MimeType == metadata.MimeTypeFolder,
+		LastMod: lastMod,
+	}
+}
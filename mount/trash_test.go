@@ -0,0 +1,89 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mount
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/rakyll/drivefuse/metadata"
+	client "github.com/rakyll/drivefuse/third_party/code.google.com/p/google-api-go-client/drive/v2"
+	"github.com/rakyll/drivefuse/third_party/code.google.com/p/rsc/fuse"
+	T "github.com/rakyll/drivefuse/third_party/launchpad.net/gocheck"
+)
+
+type TrashSuite struct{}
+
+var _ = T.Suite(&TrashSuite{})
+
+// trashTransport sends the Drive requests to a test server.
+type trashTransport struct {
+	host string
+}
+
+func (t *trashTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.URL.Scheme, req.URL.Host = "http", t.host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// fakeTrash serves a trashed folder with a child trashed along with
+// it, queries are matched by the id of the parent.
+func fakeTrash(w http.ResponseWriter, req *http.Request) {
+	folder := &client.File{Id: "folder", Title: "folder", MimeType: metadata.MimeTypeFolder, ExplicitlyTrashed: true}
+	child := &client.File{Id: "child", Title: "child.txt", DownloadUrl: "https://example.com/child", FileSize: 3}
+	list := &client.FileList{}
+	switch q := req.URL.Query().Get("q"); {
+	case strings.HasPrefix(q, "'folder' in parents"):
+		list.Items = []*client.File{child}
+	case strings.HasPrefix(q, "title = 'folder'"), q == queryTrashed:
+		list.Items = []*client.File{folder, child}
+	}
+	json.NewEncoder(w).Encode(list)
+}
+
+func (s *TrashSuite) TestTrashedFolder(c *T.C) {
+	server := httptest.NewServer(http.HandlerFunc(fakeTrash))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	service, serr := client.New(&http.Client{Transport: &trashTransport{host: host}})
+	c.Assert(serr, T.IsNil)
+	fs := &GoogleDriveFS{remoteService: service}
+	trash := &TrashFolder{fs: fs}
+
+	// children trashed along with a folder are listed under it
+	var err fuse.Error
+	ents, err := trash.ReadDir(nil)
+	c.Assert(err, T.IsNil)
+	c.Assert(ents, T.DeepEquals, []fuse.Dirent{fuse.Dirent{Name: "folder"}})
+	node, err := trash.Lookup("folder", nil)
+	c.Assert(err, T.IsNil)
+	folder := node.(*TrashedFile)
+	c.Assert(folder.IsDir, T.Equals, true)
+	ents, err = folder.ReadDir(nil)
+	c.Assert(err, T.IsNil)
+	c.Assert(ents, T.DeepEquals, []fuse.Dirent{fuse.Dirent{Name: "child.txt"}})
+
+	node, err = folder.Lookup("child.txt", nil)
+	c.Assert(err, T.IsNil)
+	child := node.(*TrashedFile)
+	c.Assert(child.IsDir, T.Equals, false)
+	c.Assert(child.Size, T.Equals, int64(3))
+	_, err = folder.Lookup("missing", nil)
+	c.Assert(err, T.Equals, fuse.ENOENT)
+	_, err = child.ReadDir(nil)
+	c.Assert(err, T.Equals, fuse.ENOENT)
+}
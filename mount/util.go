@@ -15,14 +15,108 @@
 package mount
 
 import (
+	"errors"
+	"fmt"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rakyll/drivefuse/logger"
+)
+
+const (
+	// Number of attempts to unmount a busy mount point before
+	// unmounting it lazily.
+	umountAttempts = 3
+	umountInterval = 500 * time.Millisecond
 )
 
-func Umount(mountPoint string) error {
-	err := exec.Command("umount", "-f", mountPoint).Run()
-	if err != nil && runtime.GOOS == "linux" {
-		return exec.Command("fusermount", "-u", mountPoint).Run()
+var errMounted = errors.New("already mounted")
+
+// Unmounts mountPoint, retries if it's busy and detaches it lazily
+// as the last resort. Stale mounts left behind by crashed processes
+// are unmounted as well.
+func Umount(mountPoint string) (err error) {
+	if !IsStale(mountPoint) && !isMounted(mountPoint) {
+		return nil
+	}
+	for i := 0; i < umountAttempts; i++ {
+		if err = umount(mountPoint, false); err == nil {
+			return nil
+		}
+		time.Sleep(umountInterval)
+	}
+	logger.V("unmounting lazily", mountPoint, err)
+	if err = umount(mountPoint, true); err != nil {
+		return fmt.Errorf("error unmounting %s: %v", mountPoint, err)
+	}
+	return nil
+}
+
+// IsStale tests whether mountPoint is a mount of a FUSE process
+// that is gone, accessing it fails with "transport endpoint is not
+// connected".
+func IsStale(mountPoint string) bool {
+	_, err := os.Stat(mountPoint)
+	if e, ok := err.(*os.PathError); ok {
+		return e.Err == syscall.ENOTCONN || e.Err == syscall.ENXIO
+	}
+	return false
+}
+
+// Tests whether a file system is mounted at mountPoint, it's on
+// another device than its parent.
+func isMounted(mountPoint string) bool {
+	fi, err := os.Stat(mountPoint)
+	if err != nil {
+		return false
+	}
+	parent, err := os.Stat(filepath.Dir(filepath.Clean(mountPoint)))
+	if err != nil {
+		return false
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	pst, pok := parent.Sys().(*syscall.Stat_t)
+	return ok && pok && st.Dev != pst.Dev
+}
+
+// Prepare creates mountPoint if it doesn't exist and recovers it if
+// it's stale. Fails if it's mounted by a live process.
+func Prepare(mountPoint string) error {
+	if IsStale(mountPoint) {
+		logger.V("recovering stale mount", mountPoint)
+		if err := Umount(mountPoint); err != nil {
+			return err
+		}
+	} else if isMounted(mountPoint) {
+		return fmt.Errorf("%s is %v", mountPoint, errMounted)
+	}
+	return os.MkdirAll(mountPoint, defaultFileMod)
+}
+
+func umount(mountPoint string, lazy bool) error {
+	var cmd *exec.Cmd
+	switch {
+	case runtime.GOOS == "linux" && lazy:
+		cmd = exec.Command("fusermount", "-u", "-z", mountPoint)
+	case runtime.GOOS == "linux":
+		cmd = exec.Command("fusermount", "-u", mountPoint)
+	case lazy:
+		// there are no lazy unmounts on darwin
+		cmd = exec.Command("umount", "-f", mountPoint)
+	default:
+		cmd = exec.Command("umount", mountPoint)
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("%s: %s", cmd.Args[0], msg)
+		}
+		return fmt.Errorf("%s: %v", cmd.Args[0], err)
 	}
-	return err
+	return nil
 }
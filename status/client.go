@@ -0,0 +1,90 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package status
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/rakyll/drivefuse/daemon"
+)
+
+// Client talks to a running daemon through its control socket.
+type Client struct {
+	client *http.Client
+}
+
+// Creates a client for the daemon listening on the Unix socket
+// at path.
+func NewClient(path string) *Client {
+	return &Client{client: &http.Client{
+		Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.Dial("unix", path)
+			},
+		},
+	}}
+}
+
+// Gets the status of the daemon's accounts.
+func (c *Client) Status() (statuses []*daemon.AccountStatus, err error) {
+	err = c.do("GET", "/status", nil, &statuses)
+	return
+}
+
+// Runs a full sync of the named account, blocks until it's done.
+func (c *Client) Sync(account string) error {
+	return c.do("POST", "/sync", url.Values{"account": {account}}, nil)
+}
+
+// Unmounts the named account and stops syncing it.
+func (c *Client) Unmount(account string) error {
+	return c.do("POST", "/unmount", url.Values{"account": {account}}, nil)
+}
+
+// Sends a request to the daemon, decodes the response into v
+// unless it's nil.
+func (c *Client) do(method, path string, params url.Values, v interface{}) error {
+	// host is ignored, requests are always sent to the socket
+	u := "http://drivefuse" + path
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("can't connect to the daemon, is it running? %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if err = json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Error == "" {
+			return fmt.Errorf("daemon responded with %s", resp.Status)
+		}
+		return fmt.Errorf("%s", e.Error)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,281 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package status serves the sync state of the daemon's accounts
+// over HTTP and lets local clients control syncing. It's served on
+// the control socket in the data directory, only accessible by the
+// user, and on a loopback address. POST requests on the address
+// need the token in the data directory as the X-Drivefuse-Token
+// header, so that other local users can't control syncing.
+//
+//	GET  /status                           state of all accounts
+//	GET  /queue?account=&op=download&limit= pending downloads or uploads
+//	GET  /metrics                          metrics in the Prometheus text format
+//	POST /sync?account=                    forces a full sync
+//	POST /pause?account=                   pauses syncing
+//	POST /resume?account=                  resumes syncing
+//	POST /unmount?account=                 unmounts and stops syncing
+//	POST /requeue?account=&path=           downloads a file again
+//
+// The account defaults to the first configured account.
+package status
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/rakyll/drivefuse/daemon"
+	"github.com/rakyll/drivefuse/logger"
+	"github.com/rakyll/drivefuse/metadata"
+	"github.com/rakyll/drivefuse/metrics"
+)
+
+const (
+	defaultQueueLimit = 100
+
+	headerToken = "X-Drivefuse-Token"
+)
+
+// Server is a running status service.
+type Server struct {
+	d *daemon.Daemon
+	l net.Listener
+
+	// token required by control requests, they are not
+	// authenticated if empty
+	token     string
+	tokenPath string
+}
+
+var (
+	errRunning      = errors.New("another daemon is running")
+	errInvalidToken = errors.New("invalid or missing " + headerToken + " header")
+)
+
+// Starts serving the status of d's accounts on addr. A new token
+// to control syncing is written to tokenPath, only accessible by
+// the user.
+func Start(addr string, tokenPath string, d *daemon.Daemon) (*Server, error) {
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(tokenPath, []byte(token+"\n"), 0600); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		os.Remove(tokenPath)
+		return nil, err
+	}
+	s := serve(l, d)
+	s.token, s.tokenPath = token, tokenPath
+	return s, nil
+}
+
+// Starts serving the status of d's accounts on the Unix socket at
+// path, only accessible by the user. A socket left behind by a
+// daemon that didn't exit cleanly is replaced.
+func StartUnix(path string, d *daemon.Daemon) (*Server, error) {
+	if c, err := net.Dial("unix", path); err == nil {
+		c.Close()
+		return nil, errRunning
+	}
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return serve(l, d), nil
+}
+
+// Serves the status of d's accounts on l until the server is closed.
+func serve(l net.Listener, d *daemon.Daemon) *Server {
+	s := &Server{d: d, l: l}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", s.get(s.handleStatus))
+	mux.HandleFunc("/queue", s.get(s.handleQueue))
+	mux.Handle("/metrics", metrics.Handler())
+	s.handleControl(mux)
+	go func() {
+		// returns once the listener is closed
+		http.Serve(l, mux)
+	}()
+	logger.V("Serving status on", l.Addr())
+	return s
+}
+
+func (s *Server) handleControl(mux *http.ServeMux) {
+	mux.HandleFunc("/sync", s.post(func(a *daemon.Account, r *http.Request) error {
+		return a.Sync()
+	}))
+	mux.HandleFunc("/pause", s.post(func(a *daemon.Account, r *http.Request) error {
+		return a.Pause()
+	}))
+	mux.HandleFunc("/resume", s.post(func(a *daemon.Account, r *http.Request) error {
+		return a.Resume()
+	}))
+	mux.HandleFunc("/unmount", s.post(func(a *daemon.Account, r *http.Request) error {
+		return a.Stop()
+	}))
+	mux.HandleFunc("/requeue", s.post(func(a *daemon.Account, r *http.Request) error {
+		p := r.FormValue("path")
+		if p == "" {
+			return fmt.Errorf("path is required")
+		}
+		return a.Requeue(p)
+	}))
+}
+
+// Addr gets the address the server listens on.
+func (s *Server) Addr() net.Addr {
+	return s.l.Addr()
+}
+
+// Stops serving, the token is removed.
+func (s *Server) Close() error {
+	if s.tokenPath != "" {
+		os.Remove(s.tokenPath)
+	}
+	return s.l.Close()
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	statuses := make([]*daemon.AccountStatus, 0, len(s.d.Accounts))
+	for _, a := range s.d.Accounts {
+		status, err := a.Status()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		statuses = append(statuses, status)
+	}
+	writeJSON(w, statuses)
+}
+
+func (s *Server) handleQueue(w http.ResponseWriter, r *http.Request) {
+	a := s.account(w, r)
+	if a == nil {
+		return
+	}
+	var op int
+	switch r.FormValue("op") {
+	case "", "download":
+		op = metadata.OpDownload
+	case "upload":
+		op = metadata.OpUpload
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown op %q", r.FormValue("op")))
+		return
+	}
+	limit := int64(defaultQueueLimit)
+	if v := r.FormValue("limit"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", v))
+			return
+		}
+		limit = n
+	}
+	files, err := a.Queue(op, limit)
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	if files == nil {
+		files = []*metadata.CachedDriveFile{}
+	}
+	writeJSON(w, files)
+}
+
+// Gets the account named in the request, or the first account.
+// Responds with an error if there is no such account.
+func (s *Server) account(w http.ResponseWriter, r *http.Request) *daemon.Account {
+	name := r.FormValue("account")
+	if name == "" && len(s.d.Accounts) > 0 {
+		return s.d.Accounts[0]
+	}
+	a := s.d.Account(name)
+	if a == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such account %q", name))
+	}
+	return a
+}
+
+func (s *Server) get(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+			return
+		}
+		fn(w, r)
+	}
+}
+
+func (s *Server) post(fn func(*daemon.Account, *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+			return
+		}
+		if s.token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get(headerToken)), []byte(s.token)) != 1 {
+			writeError(w, http.StatusForbidden, errInvalidToken)
+			return
+		}
+		a := s.account(w, r)
+		if a == nil {
+			return
+		}
+		if err := fn(a, r); err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		writeJSON(w, map[string]bool{"ok": true})
+	}
+}
+
+// Generates a random token to authenticate control requests.
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.V("error writing status response", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
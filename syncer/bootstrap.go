@@ -0,0 +1,195 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncer
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/rakyll/drivefuse/config"
+	"github.com/rakyll/drivefuse/logger"
+	"github.com/rakyll/drivefuse/metadata"
+	client "github.com/rakyll/drivefuse/third_party/code.google.com/p/google-api-go-client/drive/v2"
+)
+
+const (
+	maxConcurrentListings = 4
+	maxResultsPerListing  = 1000
+
+	queryChildren = "'%s' in parents and trashed=false"
+)
+
+// bootstrapper caches the current state of the synced folder by
+// listing the folders, instead of replaying the whole change log.
+// Folders are queued and listed by a fixed number of workers,
+// parents before their children.
+type bootstrapper struct {
+	syncer *CachedSyncer
+	rootId string
+
+	queue   []string // folders to be listed
+	pending int      // folders queued or being listed
+	err     error
+
+	cond *sync.Cond
+	mu   sync.Mutex
+}
+
+// Caches the descendants of the synced folder. Returns the largest
+// change id recorded before listing, changes after it are merged
+// incrementally.
+func (d *CachedSyncer) bootstrap(rootId string) (largestChangeId int64, err error) {
+	var about *client.About
+	if about, err = d.remoteService.About.Get().Do(); err != nil {
+		return
+	}
+	logger.V("Bootstrapping metadata, largest change id is", about.LargestChangeId)
+	b := &bootstrapper{
+		syncer:  d,
+		rootId:  rootId,
+		queue:   []string{rootId},
+		pending: 1,
+	}
+	b.cond = sync.NewCond(&b.mu)
+	var wg sync.WaitGroup
+	for i := 0; i < maxConcurrentListings; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.work()
+		}()
+	}
+	wg.Wait()
+	if b.err != nil {
+		return 0, b.err
+	}
+	logger.V("Done bootstrapping metadata")
+	return about.LargestChangeId, nil
+}
+
+// Lists the queued folders until all are listed or listing fails.
+func (b *bootstrapper) work() {
+	for {
+		folderId, ok := b.next()
+		if !ok {
+			return
+		}
+		folders, err := b.listChildren(folderId)
+		b.done(folders, err)
+	}
+}
+
+// Takes a folder off the queue, waits while the queue is empty but
+// folders are being listed. Returns false if there is nothing left
+// to list or listing has failed.
+func (b *bootstrapper) next() (string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for len(b.queue) == 0 && b.pending > 0 && b.err == nil {
+		b.cond.Wait()
+	}
+	if b.err != nil || len(b.queue) == 0 {
+		return "", false
+	}
+	// depth first, keeps the queue short
+	folderId := b.queue[len(b.queue)-1]
+	b.queue = b.queue[:len(b.queue)-1]
+	return folderId, true
+}
+
+// Queues the subfolders of a listed folder.
+func (b *bootstrapper) done(folders []string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err != nil && b.err == nil {
+		b.err = err
+	}
+	b.queue = append(b.queue, folders...)
+	b.pending += len(folders) - 1
+	b.cond.Broadcast()
+}
+
+// Caches the children of a folder, returns the ids of the
+// subfolders to be listed.
+func (b *bootstrapper) listChildren(folderId string) (folders []string, err error) {
+	d := b.syncer
+	parentId := folderId
+	if folderId == b.rootId {
+		parentId = metadata.IdRoot
+	}
+	pageToken := ""
+	for {
+		req := d.remoteService.Files.List().Q(fmt.Sprintf(queryChildren, folderId)).MaxResults(maxResultsPerListing)
+		if pageToken != "" {
+			req.PageToken(pageToken)
+		}
+		var list *client.FileList
+		if list, err = req.Do(); err != nil {
+			return
+		}
+		for _, item := range list.Items {
+			var ok bool
+			if ok, err = b.cacheFile(parentId, item); err != nil {
+				return
+			}
+			if ok && item.MimeType == metadata.MimeTypeFolder {
+				folders = append(folders, item.Id)
+			}
+		}
+		if pageToken = list.NextPageToken; pageToken == "" {
+			return
+		}
+	}
+}
+
+// Caches a file listed under the folder identified by parentId, the
+// file's other parents are kept if they are already cached. Returns
+// false if the file is skipped.
+func (b *bootstrapper) cacheFile(parentId string, file *client.File) (ok bool, err error) {
+	d := b.syncer
+	if file.DownloadUrl == "" && file.MimeType != metadata.MimeTypeFolder {
+		return
+	}
+	var action string
+	if action, err = d.filter.actionOf(d.metaService, parentId, file.Title, file.MimeType); err != nil || action == config.RuleHide {
+		return
+	}
+	parentIds := []string{parentId}
+	for _, p := range file.Parents {
+		id := p.Id
+		if id == b.rootId {
+			id = metadata.IdRoot
+		}
+		if id == parentId {
+			continue
+		}
+		var parent *metadata.CachedDriveFile
+		if parent, err = d.metaService.GetByRemoteId(id); err != nil {
+			return
+		}
+		if parent != nil && parent.Op != metadata.OpDelete {
+			parentIds = append(parentIds, id)
+		}
+	}
+	if err = d.metaService.RemoteMod(file.Id, parentIds, buildMetadata(file.Id, file)); err != nil {
+		return
+	}
+	if action == config.RuleExclude {
+		if err = skipDownload(d.metaService, file.Id); err != nil {
+			return
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,170 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rakyll/drivefuse/metadata"
+	client "github.com/rakyll/drivefuse/third_party/code.google.com/p/google-api-go-client/drive/v2"
+	T "github.com/rakyll/drivefuse/third_party/launchpad.net/gocheck"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) {
+	T.TestingT(t)
+}
+
+// remoteTransport sends the Drive requests to a test server.
+type remoteTransport struct {
+	host string
+}
+
+func (t *remoteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.URL.Scheme, req.URL.Host = "http", t.host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// fakeRemote serves the listings of a fixed tree of remote files.
+type fakeRemote struct {
+	files []*client.File
+}
+
+func (r *fakeRemote) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/drive/v2/about":
+		json.NewEncoder(w).Encode(&client.About{LargestChangeId: 42})
+	case "/drive/v2/files":
+		folderId := strings.Split(req.URL.Query().Get("q"), "'")[1]
+		list := &client.FileList{}
+		for _, f := range r.files {
+			for _, p := range f.Parents {
+				if p.Id == folderId {
+					list.Items = append(list.Items, f)
+				}
+			}
+		}
+		json.NewEncoder(w).Encode(list)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func remoteFile(id string, mimeType string, parentIds ...string) *client.File {
+	f := &client.File{Id: id, Title: id, MimeType: mimeType, Labels: &client.FileLabels{}}
+	if mimeType != metadata.MimeTypeFolder {
+		f.DownloadUrl = "https://example.com/" + id
+	}
+	for _, id := range parentIds {
+		f.Parents = append(f.Parents, &client.ParentReference{Id: id})
+	}
+	return f
+}
+
+type BootstrapSuite struct {
+	metaService *metadata.MetaService
+	server      *httptest.Server
+}
+
+var _ = T.Suite(&BootstrapSuite{})
+
+func (s *BootstrapSuite) SetUpTest(c *T.C) {
+	var err error
+	s.metaService, err = metadata.New(filepath.Join(c.MkDir(), "meta.sql"), nil)
+	c.Assert(err, T.IsNil)
+	c.Assert(s.metaService.RemoteMod(metadata.IdRoot, nil, &metadata.CachedDriveFile{IsDir: true}), T.IsNil)
+}
+
+func (s *BootstrapSuite) TearDownTest(c *T.C) {
+	s.metaService.Close()
+	if s.server != nil {
+		s.server.Close()
+	}
+}
+
+func (s *BootstrapSuite) syncer(c *T.C, files ...*client.File) *CachedSyncer {
+	s.server = httptest.NewServer(&fakeRemote{files: files})
+	u, err := url.Parse(s.server.URL)
+	c.Assert(err, T.IsNil)
+	remoteService, err := client.New(&http.Client{Transport: &remoteTransport{host: u.Host}})
+	c.Assert(err, T.IsNil)
+	return &CachedSyncer{
+		remoteService: remoteService,
+		metaService:   s.metaService,
+		filter:        newFilter(nil, s.metaService),
+	}
+}
+
+func (s *BootstrapSuite) parentsOf(c *T.C, remoteId string) []int64 {
+	file, err := s.metaService.GetByRemoteId(remoteId)
+	c.Assert(err, T.IsNil)
+	c.Assert(file, T.NotNil)
+	parentIds, err := s.metaService.GetParentIds(file.LocalId)
+	c.Assert(err, T.IsNil)
+	return parentIds
+}
+
+func (s *BootstrapSuite) localIdOf(c *T.C, remoteId string) int64 {
+	file, err := s.metaService.GetByRemoteId(remoteId)
+	c.Assert(err, T.IsNil)
+	c.Assert(file, T.NotNil)
+	return file.LocalId
+}
+
+func (s *BootstrapSuite) TestBootstrap(c *T.C) {
+	d := s.syncer(c,
+		remoteFile("folder", metadata.MimeTypeFolder, "rootid"),
+		remoteFile("sub", metadata.MimeTypeFolder, "folder"),
+		remoteFile("file", "text/plain", "sub"),
+	)
+	largestChangeId, err := d.bootstrap("rootid")
+	c.Assert(err, T.IsNil)
+	c.Assert(largestChangeId, T.Equals, int64(42))
+	c.Assert(s.parentsOf(c, "folder"), T.DeepEquals, []int64{s.localIdOf(c, metadata.IdRoot)})
+	c.Assert(s.parentsOf(c, "sub"), T.DeepEquals, []int64{s.localIdOf(c, "folder")})
+	c.Assert(s.parentsOf(c, "file"), T.DeepEquals, []int64{s.localIdOf(c, "sub")})
+}
+
+func (s *BootstrapSuite) TestBootstrapMultipleParents(c *T.C) {
+	d := s.syncer(c,
+		remoteFile("folder", metadata.MimeTypeFolder, "rootid"),
+		remoteFile("file", "text/plain", "rootid", "folder"),
+		remoteFile("outside", "text/plain", "folder", "unsynced"),
+	)
+	_, err := d.bootstrap("rootid")
+	c.Assert(err, T.IsNil)
+	// listed under the folder after the root, both parents are kept
+	parentIds := s.parentsOf(c, "file")
+	c.Assert(parentIds, T.HasLen, 2)
+	c.Assert(containsId(parentIds, s.localIdOf(c, metadata.IdRoot)), T.Equals, true)
+	c.Assert(containsId(parentIds, s.localIdOf(c, "folder")), T.Equals, true)
+	// parents out of the synced folder are dropped
+	c.Assert(s.parentsOf(c, "outside"), T.DeepEquals, []int64{s.localIdOf(c, "folder")})
+}
+
+func containsId(ids []int64, id int64) bool {
+	for _, item := range ids {
+		if item == id {
+			return true
+		}
+	}
+	return false
+}
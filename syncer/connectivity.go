@@ -0,0 +1,89 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncer
+
+import (
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/rakyll/drivefuse/events"
+	"github.com/rakyll/drivefuse/logger"
+)
+
+const (
+	// interval connectivity is probed at while offline
+	intervalProbe = 5 * time.Second
+)
+
+// Tests whether err is caused by the remote being unreachable,
+// rather than a failure reported by the remote.
+func isNetworkError(err error) bool {
+	for err != nil {
+		switch e := err.(type) {
+		case *url.Error:
+			err = e.Err
+		case net.Error:
+			return true
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// IsOffline tests whether the remote was unreachable at the
+// last attempt to reach it.
+func (d *CachedSyncer) IsOffline() bool {
+	d.muState.Lock()
+	defer d.muState.Unlock()
+	return d.offline
+}
+
+// Switches to offline mode if err is a network error, back to
+// online mode only once requests to the remote succeed, err is
+// nil then. Other errors, e.g. failures reported by the remote,
+// keep the mode. Transitions are published to the bus, downloads
+// are suspended while offline.
+func (d *CachedSyncer) detectConnectivity(err error) {
+	if err != nil && !isNetworkError(err) {
+		return
+	}
+	offline := err != nil
+	d.muState.Lock()
+	changed := d.offline != offline
+	d.offline = offline
+	d.muState.Unlock()
+	if !changed {
+		return
+	}
+	d.downloader.setOffline(offline)
+	if offline {
+		logger.V("remote is unreachable, switching to offline mode", err)
+		d.bus.Publish(&events.Event{Type: events.Offline, Err: err})
+		return
+	}
+	logger.V("remote is reachable, switching to online mode")
+	d.bus.Publish(&events.Event{Type: events.Online})
+}
+
+// Gets the interval until the next periodic sync, shorter while
+// offline to detect the connectivity being back.
+func (d *CachedSyncer) nextInterval() time.Duration {
+	if d.IsOffline() {
+		return intervalProbe
+	}
+	return intervalSync
+}
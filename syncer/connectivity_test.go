@@ -0,0 +1,54 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncer
+
+import (
+	"errors"
+	"net"
+	"net/url"
+
+	"github.com/rakyll/drivefuse/events"
+	"github.com/rakyll/drivefuse/third_party/code.google.com/p/google-api-go-client/googleapi"
+	T "github.com/rakyll/drivefuse/third_party/launchpad.net/gocheck"
+)
+
+type ConnectivitySuite struct{}
+
+var _ = T.Suite(&ConnectivitySuite{})
+
+func (s *ConnectivitySuite) TestDetectConnectivity(c *T.C) {
+	bus := events.New("work")
+	var transitions []events.Type
+	bus.Subscribe(func(e *events.Event) {
+		transitions = append(transitions, e.Type)
+	})
+	d := &CachedSyncer{downloader: &Downloader{}, bus: bus}
+	unreachable := &url.Error{Op: "Get", URL: "https://www.googleapis.com/drive/v2/changes", Err: &net.OpError{Op: "dial", Err: errors.New("no route to host")}}
+
+	d.detectConnectivity(unreachable)
+	c.Assert(d.IsOffline(), T.Equals, true)
+	c.Assert(d.downloader.isPaused(), T.Equals, true)
+	// failures reported by the remote don't bring it back online
+	d.detectConnectivity(&googleapi.Error{Code: 503})
+	d.detectConnectivity(&googleapi.Error{Code: 401})
+	d.detectConnectivity(errParentNotSynced)
+	c.Assert(d.IsOffline(), T.Equals, true)
+	d.detectConnectivity(nil)
+	c.Assert(d.IsOffline(), T.Equals, false)
+	c.Assert(d.downloader.isPaused(), T.Equals, false)
+	d.detectConnectivity(&googleapi.Error{Code: 503})
+	c.Assert(d.IsOffline(), T.Equals, false)
+	c.Assert(transitions, T.DeepEquals, []events.Type{events.Offline, events.Online})
+}
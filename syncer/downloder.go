@@ -15,12 +15,17 @@
 package syncer
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"math"
 	"net/http"
 	"sync"
 	"time"
 
 	"github.com/rakyll/drivefuse/blob"
+	"github.com/rakyll/drivefuse/config"
+	"github.com/rakyll/drivefuse/events"
 	"github.com/rakyll/drivefuse/logger"
 	"github.com/rakyll/drivefuse/metadata"
 )
@@ -33,38 +38,89 @@ const (
 	baseUrlDownloadHost = "https://googledrive.com/host"
 )
 
+var errNotFound = errors.New("file not found")
+
 type Downloader struct {
 	client      *http.Client
 	metaService *metadata.MetaService
 	blobMngr    *blob.Manager
+	filter      *filter
+	bus         *events.Bus
+
+	done chan struct{}
+
+	paused  bool
+	offline bool
+	muPause sync.Mutex
 
 	muSmall sync.Mutex
 	muLarge sync.Mutex
 }
 
-func NewDownloader(client *http.Client, m *metadata.MetaService, blobMngr *blob.Manager) *Downloader {
-	downloader := &Downloader{
+func NewDownloader(client *http.Client, m *metadata.MetaService, blobMngr *blob.Manager, filter *filter, bus *events.Bus) *Downloader {
+	return &Downloader{
 		client:      client,
 		metaService: m,
 		blobMngr:    blobMngr,
+		filter:      filter,
+		bus:         bus,
+		done:        make(chan struct{}),
 	}
-	downloader.Start()
-	return downloader
 }
 
 func (d *Downloader) Start() {
-	go func() {
-		for {
-			d.tickForSmall()
-			<-time.After(intervalTick)
+	go d.loop(d.tickForSmall)
+	go d.loop(d.tickForLarge)
+}
+
+// Stops the download queues, waits for the downloads in progress.
+func (d *Downloader) Stop() {
+	close(d.done)
+	d.muSmall.Lock()
+	d.muLarge.Lock()
+	defer d.muSmall.Unlock()
+	defer d.muLarge.Unlock()
+}
+
+// Pauses the download queues, downloads in progress are completed.
+func (d *Downloader) Pause() {
+	d.muPause.Lock()
+	defer d.muPause.Unlock()
+	d.paused = true
+}
+
+// Resumes the download queues.
+func (d *Downloader) Resume() {
+	d.muPause.Lock()
+	defer d.muPause.Unlock()
+	d.paused = false
+}
+
+// Suspends the download queues while the remote is unreachable,
+// queued files are downloaded once it's back.
+func (d *Downloader) setOffline(offline bool) {
+	d.muPause.Lock()
+	defer d.muPause.Unlock()
+	d.offline = offline
+}
+
+func (d *Downloader) isPaused() bool {
+	d.muPause.Lock()
+	defer d.muPause.Unlock()
+	return d.paused || d.offline
+}
+
+func (d *Downloader) loop(tick func()) {
+	for {
+		if !d.isPaused() {
+			tick()
 		}
-	}()
-	go func() {
-		for {
-			d.tickForLarge()
-			<-time.After(intervalTick)
+		select {
+		case <-time.After(intervalTick):
+		case <-d.done:
+			return
 		}
-	}()
+	}
 }
 
 func (d *Downloader) tickForSmall() {
@@ -83,7 +139,21 @@ func (d *Downloader) tick(minSize int64, maxSize int64) {
 	// TODO: add an additional queue for small sized files
 	// so that, large files dont block the download queue.
 	// retrieve at least MaxNumberOfConcurrentDownloads files to download
-	downloads, _ := d.metaService.ListDownloads(maxNumberOfConcurrentDownloadsPerQueue, minSize, maxSize)
+	queued, _ := d.metaService.ListDownloads(maxNumberOfConcurrentDownloadsPerQueue, minSize, maxSize)
+	downloads := queued[:0]
+	for _, item := range queued {
+		// files might be moved under excluded folders once queued,
+		// files read on demand are downloaded regardless
+		if item.Op != metadata.OpDownload {
+			downloads = append(downloads, item)
+			continue
+		}
+		if action, err := d.filter.actionOfCached(item); err == nil && action != config.RuleInclude {
+			d.metaService.SetOp(item.LocalId, metadata.OpNone)
+			continue
+		}
+		downloads = append(downloads, item)
+	}
 	if len(downloads) == 0 {
 		return
 	}
@@ -98,35 +168,64 @@ func (d *Downloader) tick(minSize int64, maxSize int64) {
 }
 
 func (d *Downloader) download(localId int64, remoteId string, checksum string) {
+	e := &events.Event{LocalId: localId, RemoteId: remoteId}
+	d.publish(events.DownloadStarted, e, nil)
+	start := time.Now()
+	err := d.fetch(localId, remoteId, checksum)
+	downloadLatency.ObserveSince(start, d.bus.Account())
+	if err != nil {
+		downloads.Inc(d.bus.Account(), "error")
+		d.publish(events.DownloadFailed, e, err)
+		return
+	}
+	downloads.Inc(d.bus.Account(), "ok")
+	d.publish(events.DownloadFinished, e, nil)
+}
+
+func (d *Downloader) publish(t events.Type, e *events.Event, err error) {
+	d.bus.Publish(&events.Event{Type: t, LocalId: e.LocalId, RemoteId: e.RemoteId, Err: err})
+}
+
+func (d *Downloader) fetch(localId int64, remoteId string, checksum string) (err error) {
 	// TODO: handle all error cases, make sure queue is not blocked
 	// with erroneous files
 	logger.V("Downloading", remoteId, checksum)
-	var (
-		resp *http.Response
-		err  error
-	)
+	var resp *http.Response
 	if resp, err = d.client.Get(baseUrlDownloadHost + "/" + remoteId); err != nil {
 		logger.V("error downloading", remoteId, err)
 		return
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode == 404 {
 		d.metaService.SetOp(localId, metadata.OpNone)
 		logger.V("error downloading [not found]", remoteId)
-		return
+		return errNotFound
 	}
 
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
 		logger.V("error downloading [not ok]", remoteId, resp.StatusCode)
-		return
+		return fmt.Errorf("download failed with status %d", resp.StatusCode)
 	}
 
-	defer resp.Body.Close()
-	err = d.blobMngr.Save(localId, checksum, resp.Body)
-	if err != nil {
+	body := &countingReader{ReadCloser: resp.Body, account: d.bus.Account()}
+	if err = d.blobMngr.Save(localId, checksum, body); err != nil {
 		logger.V(err)
 		return
 	}
+	return d.metaService.SetOp(localId, metadata.OpNone)
+}
+
+// countingReader counts the bytes downloaded.
+type countingReader struct {
+	io.ReadCloser
+	account string
+}
 
-	d.metaService.SetOp(localId, metadata.OpNone)
+func (r *countingReader) Read(p []byte) (n int, err error) {
+	n, err = r.ReadCloser.Read(p)
+	if n > 0 {
+		downloadedBytes.Add(float64(n), r.account)
+	}
+	return
 }
@@ -0,0 +1,74 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncer
+
+import (
+	"path"
+
+	"github.com/rakyll/drivefuse/config"
+	"github.com/rakyll/drivefuse/metadata"
+)
+
+// filter evaluates the account's sync rules against the paths of
+// cached files. Paths are resolved through the first parents.
+type filter struct {
+	rules       []config.Rule
+	metaService *metadata.MetaService
+}
+
+func newFilter(rules []config.Rule, metaService *metadata.MetaService) *filter {
+	return &filter{rules: rules, metaService: metaService}
+}
+
+// Gets the action for a file named with name under the cached folder
+// identified by parentRemoteId, folders are looked up in store.
+func (f *filter) actionOf(store metaStore, parentRemoteId string, name string, mimeType string) (string, error) {
+	if len(f.rules) == 0 {
+		return config.RuleInclude, nil
+	}
+	parent, err := store.GetByRemoteId(parentRemoteId)
+	if err != nil || parent == nil {
+		return config.RuleInclude, err
+	}
+	p, err := pathOf(store, parent)
+	if err != nil {
+		return config.RuleInclude, err
+	}
+	return config.MatchRules(f.rules, path.Join(p, name), mimeType), nil
+}
+
+// Gets the action for a cached file. Files cached before their types
+// are have no MIME type, rules with a MIME pattern don't match them.
+func (f *filter) actionOfCached(file *metadata.CachedDriveFile) (string, error) {
+	if len(f.rules) == 0 {
+		return config.RuleInclude, nil
+	}
+	p, err := pathOf(f.metaService, file)
+	if err != nil {
+		return config.RuleInclude, err
+	}
+	return config.MatchRules(f.rules, p, file.MimeType), nil
+}
+
+// Gets the path of a cached file relative to the root.
+func pathOf(store metaStore, file *metadata.CachedDriveFile) (p string, err error) {
+	for depth := 0; file != nil && file.LocalParentId > 0 && depth < maxScopeDepth; depth++ {
+		p = path.Join(file.Name, p)
+		if file, err = store.GetByLocalId(file.LocalParentId); err != nil {
+			return
+		}
+	}
+	return
+}
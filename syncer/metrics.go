@@ -0,0 +1,46 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncer
+
+import (
+	"github.com/rakyll/drivefuse/metrics"
+)
+
+var (
+	syncs = metrics.NewCounter(
+		"drivefuse_syncs_total",
+		"Syncs run, result is either ok or error.",
+		"account", "result")
+	syncLatency = metrics.NewHistogram(
+		"drivefuse_sync_duration_seconds",
+		"Time taken by syncs, including the failed ones.",
+		metrics.DefBuckets, "account")
+	changeIdLag = metrics.NewGauge(
+		"drivefuse_change_id_lag",
+		"Difference between the largest remote change id and the largest merged change id.",
+		"account")
+	downloads = metrics.NewCounter(
+		"drivefuse_downloads_total",
+		"Downloads from the queue, result is either ok or error.",
+		"account", "result")
+	downloadedBytes = metrics.NewCounter(
+		"drivefuse_downloaded_bytes_total",
+		"Bytes of file contents saved to the blob cache.",
+		"account")
+	downloadLatency = metrics.NewHistogram(
+		"drivefuse_download_duration_seconds",
+		"Time taken by downloads from the queue, including the failed ones.",
+		metrics.DefBuckets, "account")
+)
@@ -0,0 +1,268 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncer
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/rakyll/drivefuse/blob"
+	"github.com/rakyll/drivefuse/events"
+	"github.com/rakyll/drivefuse/logger"
+	"github.com/rakyll/drivefuse/metadata"
+	client "github.com/rakyll/drivefuse/third_party/code.google.com/p/google-api-go-client/drive/v2"
+	"github.com/rakyll/drivefuse/third_party/code.google.com/p/google-api-go-client/googleapi"
+)
+
+const (
+	// number of journal entries replayed at once
+	maxJournalPage = 100
+)
+
+var (
+	errParentNotSynced = errors.New("parent is not synced to the remote yet")
+	errNotCached       = errors.New("written contents are not cached")
+)
+
+// Propagates the local changes to the remote by replaying the
+// compacted journal in order. Replaying stops at the first
+// failure, the failed entry is retried at the next sync.
+func (d *CachedSyncer) syncOutbound() (err error) {
+	var dropped int
+	if dropped, err = d.metaService.CompactJournal(); err != nil {
+		return
+	}
+	if dropped > 0 {
+		logger.V("Compacted", dropped, "journal entries")
+	}
+	for {
+		var entries []*metadata.JournalEntry
+		if entries, err = d.metaService.ListJournal(maxJournalPage); err != nil || len(entries) == 0 {
+			return
+		}
+		for _, e := range entries {
+			if err = d.replay(e); err != nil {
+				logger.V("error replaying journal entry", e.Seq, err)
+				return
+			}
+			if err = d.metaService.CompleteJournalEntry(e); err != nil {
+				return
+			}
+			if e.Kind == metadata.JournalRemove && !e.IsDir {
+				d.downloader.blobMngr.Delete(e.LocalId)
+			}
+		}
+	}
+}
+
+func (d *CachedSyncer) replay(e *metadata.JournalEntry) (err error) {
+	var file *metadata.CachedDriveFile
+	if file, err = d.metaService.GetByLocalId(e.LocalId); err != nil || file == nil {
+		return
+	}
+	switch e.Kind {
+	case metadata.JournalCreate:
+		if e.IsLocal || file.Id != "" {
+			return
+		}
+		return d.replayCreate(file, e)
+	case metadata.JournalRename:
+		if file.Id == "" {
+			if e.IsLocal {
+				return
+			}
+			// was local-only, created once it's renamed
+			return d.replayCreate(file, e)
+		}
+		return ignoreNotFound(d.replayRename(file, e))
+	case metadata.JournalRemove:
+		if file.Id == "" {
+			return
+		}
+		logger.V("Trashing", file.Id)
+		_, err = d.remoteService.Files.Trash(file.Id).Do()
+		return ignoreNotFound(err)
+	case metadata.JournalModify:
+		if e.IsLocal || file.Id == "" {
+			return
+		}
+		return ignoreNotFound(d.replayModify(file))
+	case metadata.JournalLink, metadata.JournalUnlink:
+		if e.IsLocal || file.Id == "" {
+			return
+		}
+		return ignoreNotFound(d.replayLink(file, e))
+	}
+	return
+}
+
+// Creates a file with the cached contents, a symlink or a folder on
+// the remote at the location the entry leads to.
+func (d *CachedSyncer) replayCreate(file *metadata.CachedDriveFile, e *metadata.JournalEntry) (err error) {
+	var parentId string
+	if parentId, err = d.remoteIdOf(e.LocalParentId); err != nil {
+		return
+	}
+	remote := &client.File{
+		Title:   e.Name,
+		Parents: []*client.ParentReference{&client.ParentReference{Id: parentId}},
+	}
+	req := d.remoteService.Files.Insert(remote)
+	if e.IsDir {
+		remote.MimeType = metadata.MimeTypeFolder
+	} else if file.LinkTarget != "" {
+		remote.MimeType = metadata.MimeTypeSymlink
+		remote.Properties = []*client.Property{&client.Property{
+			Key:        metadata.PropertySymlinkTarget,
+			Value:      file.LinkTarget,
+			Visibility: "PUBLIC",
+		}}
+		req.Media(strings.NewReader(file.LinkTarget))
+	} else {
+		var contents io.ReadCloser
+		if contents, err = d.openContents(file); err != nil {
+			return
+		}
+		defer contents.Close()
+		req.Media(contents)
+	}
+	logger.V("Creating", e.Name, "under", parentId)
+	if remote, err = req.Do(); err != nil {
+		return
+	}
+	return d.uploaded(file, remote)
+}
+
+// Uploads the cached contents of a modified file.
+func (d *CachedSyncer) replayModify(file *metadata.CachedDriveFile) (err error) {
+	var contents io.ReadCloser
+	if contents, err = d.openContents(file); err != nil {
+		return
+	}
+	defer contents.Close()
+	logger.V("Uploading", file.Id)
+	var remote *client.File
+	if remote, err = d.remoteService.Files.Update(file.Id, &client.File{}).Media(contents).Do(); err != nil {
+		return
+	}
+	return d.uploaded(file, remote)
+}
+
+// Opens the written contents of a file to upload, files that are
+// never written are empty. Contents that are not cached can't be
+// uploaded, the entry is retried rather than emptying the file.
+func (d *CachedSyncer) openContents(file *metadata.CachedDriveFile) (io.ReadCloser, error) {
+	f, err := d.downloader.blobMngr.Open(file.LocalId, blob.LocalChecksum)
+	if os.IsNotExist(err) {
+		if file.FileSize == 0 {
+			return ioutil.NopCloser(strings.NewReader("")), nil
+		}
+		return nil, errNotCached
+	}
+	return f, err
+}
+
+// Links the cached file to the uploaded remote file. The written
+// contents are renamed after the checksum of the uploaded ones,
+// unless they are written again and yet to be uploaded.
+func (d *CachedSyncer) uploaded(file *metadata.CachedDriveFile, remote *client.File) (err error) {
+	var n int64
+	if n, err = d.metaService.CountUploads(file.LocalId); err != nil {
+		return
+	}
+	if n <= 1 {
+		if err = d.downloader.blobMngr.Rename(file.LocalId, blob.LocalChecksum, remote.Md5Checksum); err != nil && !os.IsNotExist(err) {
+			return
+		}
+	}
+	if err = d.metaService.SetUploaded(file.LocalId, remote.Id, remote.Md5Checksum); err != nil {
+		return
+	}
+	d.bus.Publish(&events.Event{Type: events.UploadFinished, LocalId: file.LocalId, RemoteId: remote.Id, Name: file.Name})
+	return
+}
+
+// Renames the remote file, moves it from the old parent to the
+// new one. Other parents of the file are kept.
+func (d *CachedSyncer) replayRename(file *metadata.CachedDriveFile, e *metadata.JournalEntry) (err error) {
+	if e.Name != e.OldName {
+		logger.V("Renaming", file.Id, "to", e.Name)
+		if _, err = d.remoteService.Files.Patch(file.Id, &client.File{Title: e.Name}).Do(); err != nil {
+			return
+		}
+	}
+	if e.LocalParentId == e.OldLocalParentId {
+		return
+	}
+	var parentId, oldParentId string
+	if parentId, err = d.remoteIdOf(e.LocalParentId); err != nil {
+		return
+	}
+	if oldParentId, err = d.remoteIdOf(e.OldLocalParentId); err != nil {
+		return
+	}
+	logger.V("Moving", file.Id, "from", oldParentId, "to", parentId)
+	if _, err = d.remoteService.Parents.Insert(file.Id, &client.ParentReference{Id: parentId}).Do(); err != nil {
+		return
+	}
+	return ignoreNotFound(d.remoteService.Parents.Delete(file.Id, oldParentId).Do())
+}
+
+// Adds the parent a linked file is added to, or removes the one an
+// unlinked file is removed from.
+func (d *CachedSyncer) replayLink(file *metadata.CachedDriveFile, e *metadata.JournalEntry) (err error) {
+	var parentId string
+	if e.Kind == metadata.JournalLink {
+		if parentId, err = d.remoteIdOf(e.LocalParentId); err != nil {
+			return
+		}
+		logger.V("Adding parent", parentId, "to", file.Id)
+		_, err = d.remoteService.Parents.Insert(file.Id, &client.ParentReference{Id: parentId}).Do()
+		return
+	}
+	if parentId, err = d.remoteIdOf(e.OldLocalParentId); err != nil {
+		return
+	}
+	logger.V("Removing parent", parentId, "from", file.Id)
+	return d.remoteService.Parents.Delete(file.Id, parentId).Do()
+}
+
+// Gets the remote id of a cached folder, the synced folder is
+// cached with the root alias.
+func (d *CachedSyncer) remoteIdOf(localId int64) (string, error) {
+	folder, err := d.metaService.GetByLocalId(localId)
+	if err != nil {
+		return "", err
+	}
+	if folder == nil || folder.Id == "" {
+		return "", errParentNotSynced
+	}
+	if folder.Id == metadata.IdRoot {
+		return d.remoteId, nil
+	}
+	return folder.Id, nil
+}
+
+// Changes to the files removed from the remote are dropped.
+func ignoreNotFound(err error) error {
+	if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
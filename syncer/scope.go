@@ -0,0 +1,131 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncer
+
+import (
+	"github.com/rakyll/drivefuse/config"
+	"github.com/rakyll/drivefuse/metadata"
+	client "github.com/rakyll/drivefuse/third_party/code.google.com/p/google-api-go-client/drive/v2"
+)
+
+const (
+	maxScopeDepth = 64
+)
+
+// scope limits syncing to the descendants of the synced folder.
+// Folders that are not cached yet are retrieved from the remote
+// and cached before their children, regardless of the order
+// of the changes.
+type scope struct {
+	rootId string
+
+	remoteService *client.Service
+	filter        *filter
+
+	folders map[string]bool // whether a folder is a descendant
+}
+
+func newScope(rootId string, remoteService *client.Service, filter *filter) *scope {
+	return &scope{
+		rootId:        rootId,
+		remoteService: remoteService,
+		filter:        filter,
+		folders:       make(map[string]bool),
+	}
+}
+
+// Gets the parents of file that are in the scope, the synced folder
+// is replaced with the root alias. Returns no parents if file is not
+// a descendant of the synced folder. Folders that are not cached
+// are out of the scope, they should be resolved beforehand.
+func (s *scope) parentsOf(store metaStore, file *client.File) ([]string, error) {
+	return s.parentsWithDepth(store, file, 0, false)
+}
+
+// Retrieves the folders file descends from from the remote and
+// caches the ones in the scope in store. It's called before
+// merging changes, so that the metadata is not locked while
+// waiting for the remote.
+func (s *scope) resolve(store metaStore, file *client.File) error {
+	_, err := s.parentsWithDepth(store, file, 0, true)
+	return err
+}
+
+func (s *scope) parentsWithDepth(store metaStore, file *client.File, depth int, fetch bool) (parentIds []string, err error) {
+	for _, p := range file.Parents {
+		var ok bool
+		if ok, err = s.contains(store, p.Id, depth, fetch); err != nil {
+			return
+		}
+		if !ok {
+			continue
+		}
+		if p.Id == s.rootId {
+			parentIds = append(parentIds, metadata.IdRoot)
+		} else {
+			parentIds = append(parentIds, p.Id)
+		}
+	}
+	return
+}
+
+func (s *scope) contains(store metaStore, folderId string, depth int, fetch bool) (ok bool, err error) {
+	if folderId == s.rootId {
+		return true, nil
+	}
+	if ok, cached := s.folders[folderId]; cached {
+		return ok, nil
+	}
+	var folder *metadata.CachedDriveFile
+	if folder, err = store.GetByRemoteId(folderId); err != nil {
+		return
+	}
+	if folder != nil && folder.IsDir && folder.Op != metadata.OpDelete && folder.LocalParentId > 0 {
+		s.folders[folderId] = true
+		return true, nil
+	}
+	if !fetch || depth > maxScopeDepth {
+		return false, nil
+	}
+
+	// unknown folder, look up for its ancestors
+	var file *client.File
+	if file, err = s.remoteService.Files.Get(folderId).Do(); err != nil {
+		return
+	}
+	var parentIds []string
+	if !file.Labels.Trashed {
+		if parentIds, err = s.parentsWithDepth(store, file, depth+1, fetch); err != nil {
+			return
+		}
+	}
+	if len(parentIds) > 0 {
+		// children of hidden folders are hidden as well
+		var action string
+		if action, err = s.filter.actionOf(store, parentIds[0], file.Title, file.MimeType); err != nil {
+			return
+		}
+		if action == config.RuleHide {
+			parentIds = nil
+		}
+	}
+	if ok = len(parentIds) > 0; ok {
+		if err = store.RemoteMod(folderId, parentIds, buildMetadata(folderId, file)); err != nil {
+			return
+		}
+	}
+	s.folders[folderId] = ok
+	return
+}
@@ -19,6 +19,8 @@ import (
 	"time"
 
 	"github.com/rakyll/drivefuse/blob"
+	"github.com/rakyll/drivefuse/config"
+	"github.com/rakyll/drivefuse/events"
 	"github.com/rakyll/drivefuse/logger"
 	"github.com/rakyll/drivefuse/metadata"
 	"github.com/rakyll/drivefuse/third_party/code.google.com/p/goauth2/oauth"
@@ -33,70 +35,175 @@ const (
 type CachedSyncer struct {
 	downloader *Downloader
 
+	// remote id of the synced folder
+	remoteId string
+
+	// whether changes of the items shared with the user are merged
+	includeShared bool
+
 	remoteService *client.Service
 	metaService   *metadata.MetaService
+	scope         *scope
+	filter        *filter
+	bus           *events.Bus
+
+	done chan struct{}
+
+	paused  bool
+	syncing bool
+	offline bool
+	muState sync.Mutex
 
 	mu sync.RWMutex
 }
 
-func NewCachedSyncer(t *oauth.Transport, metaService *metadata.MetaService, blobManager *blob.Manager) *CachedSyncer {
+// Creates a syncer that syncs the descendants of the account's remote
+// folder, syncs the whole Drive if the remote folder is root. Files
+// are filtered with the account's rules. Sync activity is published
+// to bus.
+func NewCachedSyncer(t *oauth.Transport, account *config.Account, metaService *metadata.MetaService, blobManager *blob.Manager, bus *events.Bus) *CachedSyncer {
 	driveService, _ := client.New(t.Client())
+	remoteId := account.RemoteId
+	if remoteId == "" {
+		remoteId = metadata.IdRoot
+	}
+	filter := newFilter(account.Rules, metaService)
 	return &CachedSyncer{
-		downloader:    NewDownloader(t.Client(), metaService, blobManager),
+		downloader:    NewDownloader(t.Client(), metaService, blobManager, filter, bus),
+		remoteId:      remoteId,
+		includeShared: account.SharedWithMe,
+		filter:        filter,
+		bus:           bus,
 		remoteService: driveService,
 		metaService:   metaService,
+		done:          make(chan struct{}),
 	}
 }
 
 func (d *CachedSyncer) Start() {
 	go func() {
 		for {
-			d.Sync(false)
-			<-time.After(intervalSync)
+			if !d.IsPaused() {
+				d.Sync(false)
+			}
+			select {
+			case <-time.After(d.nextInterval()):
+			case <-d.done:
+				return
+			}
 		}
 	}()
 	d.downloader.Start()
 }
 
+// Stops the periodic syncing and downloads, waits for
+// the running sync to be finished.
+func (d *CachedSyncer) Stop() {
+	close(d.done)
+	d.downloader.Stop()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+}
+
+// Pauses the periodic syncing and downloads, explicit syncs
+// are still run.
+func (d *CachedSyncer) Pause() {
+	d.muState.Lock()
+	defer d.muState.Unlock()
+	d.paused = true
+	d.downloader.Pause()
+}
+
+// Resumes the periodic syncing and downloads.
+func (d *CachedSyncer) Resume() {
+	d.muState.Lock()
+	defer d.muState.Unlock()
+	d.paused = false
+	d.downloader.Resume()
+}
+
+// IsSyncing tests whether a sync is in progress.
+func (d *CachedSyncer) IsSyncing() bool {
+	d.muState.Lock()
+	defer d.muState.Unlock()
+	return d.syncing
+}
+
+func (d *CachedSyncer) setSyncing(syncing bool) {
+	d.muState.Lock()
+	defer d.muState.Unlock()
+	d.syncing = syncing
+}
+
+// IsPaused tests whether the syncer is paused.
+func (d *CachedSyncer) IsPaused() bool {
+	d.muState.Lock()
+	defer d.muState.Unlock()
+	return d.paused
+}
+
 func (d *CachedSyncer) Sync(isForce bool) (err error) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
 	logger.V("Started syncer...")
-	err = d.syncInbound(isForce)
+	d.setSyncing(true)
+	defer d.setSyncing(false)
+	start := time.Now()
+	if err = d.syncInbound(isForce); err == nil {
+		// remote is reachable once the changes are merged,
+		// local changes are replayed only while online
+		d.detectConnectivity(nil)
+		err = d.syncOutbound()
+	}
+	syncLatency.ObserveSince(start, d.bus.Account())
+	d.detectConnectivity(err)
 	if err != nil {
 		logger.V("error during sync", err)
+		syncs.Inc(d.bus.Account(), "error")
+		d.bus.Publish(&events.Event{Type: events.SyncFailed, Err: err})
 		return
 	}
 	logger.V("Done syncing...")
+	syncs.Inc(d.bus.Account(), "ok")
+	d.bus.Publish(&events.Event{Type: events.SyncCompleted})
 	return
 }
 
-func (d *CachedSyncer) syncOutbound(rootId string, isRecursive bool, isForce bool) error {
-	panic("not implemented")
-	return nil
-}
-
 func (d *CachedSyncer) syncInbound(isForce bool) (err error) {
 	var largestChangeId int64
 	largestChangeId, err = d.metaService.GetLargestChangeId()
-	isInitialSync := largestChangeId == 0
-	if isForce || err != nil {
+	isInitialSync := err != nil || largestChangeId == 0
+	if isForce {
+		// replay the whole change log, listing the current state
+		// doesn't remove the files deleted since the last sync
 		largestChangeId = 0
 	} else {
 		largestChangeId += 1
 	}
 
-	// retrieve metadata about root
+	// retrieve metadata about the synced folder, it's cached as the root
 	var rootFile *client.File
-	if rootFile, err = d.remoteService.Files.Get(metadata.IdRoot).Do(); err != nil {
+	if rootFile, err = d.remoteService.Files.Get(d.remoteId).Do(); err != nil {
 		return
 	}
+	d.scope = newScope(rootFile.Id, d.remoteService, d.filter)
 
 	data := buildMetadata(metadata.IdRoot, rootFile)
-	if err = d.metaService.RemoteMod(metadata.IdRoot, "", data); err != nil {
+	if err = d.metaService.RemoteMod(metadata.IdRoot, nil, data); err != nil {
 		return
 	}
+	if isInitialSync {
+		// list the current state rather than replaying all changes
+		if largestChangeId, err = d.bootstrap(rootFile.Id); err != nil {
+			return
+		}
+		if err = d.metaService.SaveLargestChangeId(largestChangeId); err != nil {
+			return
+		}
+		isInitialSync = false
+		largestChangeId += 1
+	}
 	pageToken := ""
 	for {
 		pageToken, err = d.mergeChanges(isInitialSync, rootFile.Id, largestChangeId, pageToken)
@@ -111,7 +218,7 @@ func (d *CachedSyncer) mergeChanges(isInitialSync bool, rootId string, startChan
 	logger.V("merging changes starting with pageToken:", pageToken, "and startChangeId", startChangeId)
 
 	req := d.remoteService.Changes.List()
-	req.IncludeSubscribed(false)
+	req.IncludeSubscribed(d.includeShared)
 	if pageToken != "" {
 		req.PageToken(pageToken)
 	} else if startChangeId > 0 { // can't set page token and start change mutually
@@ -126,48 +233,90 @@ func (d *CachedSyncer) mergeChanges(isInitialSync bool, rootId string, startChan
 		return
 	}
 
-	var largestId int64
 	nextPageToken = changes.NextPageToken
+	if len(changes.Items) == 0 {
+		changeIdLag.Set(0, d.bus.Account())
+		return
+	}
+	// look up the missing folders before locking the metadata
+	for _, item := range changes.Items {
+		if item.Deleted || item.File.Labels.Trashed || item.FileId == rootId {
+			continue
+		}
+		if err = d.scope.resolve(d.metaService, item.File); err != nil {
+			return
+		}
+	}
+	// apply the page and its largest change id at once
+	var tx *metadata.Tx
+	if tx, err = d.metaService.Begin(); err != nil {
+		return
+	}
 	for _, item := range changes.Items {
-		if err = d.mergeChange(rootId, item); err != nil {
+		if err = d.mergeChange(tx, rootId, item); err != nil {
+			tx.Rollback()
 			return
 		}
-		largestId = item.Id
 	}
-	if largestId > 0 {
-		// persist largest change id
-		d.metaService.SaveLargestChangeId(largestId)
+	if err = tx.SaveLargestChangeId(changes.Items[len(changes.Items)-1].Id); err != nil {
+		tx.Rollback()
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		return
 	}
+	changeIdLag.Set(float64(changes.LargestChangeId-changes.Items[len(changes.Items)-1].Id), d.bus.Account())
 	return
 }
 
-func (d *CachedSyncer) mergeChange(rootId string, item *client.Change) (err error) {
+func (d *CachedSyncer) mergeChange(store metaStore, rootId string, item *client.Change) (err error) {
 	if item.Deleted || item.File.Labels.Trashed {
 		// TODO(burcud): Handle directory deletions
-		if d.metaService.RemoteRm(item.FileId); err != nil {
-			return
-		}
+		return store.RemoteRm(item.FileId)
 	} else {
 		if item.File.DownloadUrl == "" && item.File.MimeType != metadata.MimeTypeFolder {
 			return
 		}
+		if item.FileId == rootId {
+			return store.RemoteMod(metadata.IdRoot, nil, buildMetadata(metadata.IdRoot, item.File))
+		}
 
 		fileId := item.FileId
-		parentId := ""
-		if len(item.File.Parents) > 0 {
-			parentId = item.File.Parents[0].Id
+		var parentIds []string
+		if parentIds, err = d.scope.parentsOf(store, item.File); err != nil {
+			return
+		}
+		if len(parentIds) == 0 {
+			// not a descendant of the synced folder, might be moved out
+			return store.RemoteRm(fileId)
+		}
+		var action string
+		if action, err = d.filter.actionOf(store, parentIds[0], item.File.Title, item.File.MimeType); err != nil {
+			return
 		}
-		if parentId == rootId {
-			parentId = metadata.IdRoot
+		if action == config.RuleHide {
+			return store.RemoteRm(fileId)
 		}
-		metadata := buildMetadata(item.FileId, item.File)
-		if err = d.metaService.RemoteMod(fileId, parentId, metadata); err != nil {
+		if err = store.RemoteMod(fileId, parentIds, buildMetadata(item.FileId, item.File)); err != nil {
 			return
 		}
+		if action == config.RuleExclude {
+			err = skipDownload(store, fileId)
+		}
 	}
 	return
 }
 
+// Removes an excluded file from the download queue, it's
+// only listed.
+func skipDownload(store metaStore, remoteId string) error {
+	file, err := store.GetByRemoteId(remoteId)
+	if err != nil || file == nil || file.Op != metadata.OpDownload {
+		return err
+	}
+	return store.SetOp(file.LocalId, metadata.OpNone)
+}
+
 func buildMetadata(id string, file *client.File) *metadata.CachedDriveFile {
 	lastMod, _ := time.Parse(layoutDateTime, file.ModifiedDate)
 	driveFile := &metadata.CachedDriveFile{
@@ -177,7 +326,13 @@ func buildMetadata(id string, file *client.File) *metadata.CachedDriveFile {
 		Md5Checksum: file.Md5Checksum,
 		LastEtag:    file.Etag,
 		LastMod:     lastMod,
+		MimeType:    file.MimeType,
 	}
 	driveFile.IsDir = file.MimeType == metadata.MimeTypeFolder
+	for _, p := range file.Properties {
+		if p.Key == metadata.PropertySymlinkTarget {
+			driveFile.LinkTarget = p.Value
+		}
+	}
 	return driveFile
 }
@@ -14,12 +14,29 @@
 
 package syncer
 
+import (
+	"github.com/rakyll/drivefuse/metadata"
+)
+
 type Syncer interface {
 	// Starts a periodic syncing, returns immediately.
 	Start()
 
+	// Stops the periodic syncing.
+	Stop()
+
 	// Starts a sync if no syncing ,waits for the existing
 	// sync process to be finished. Ignores incremental syncs
 	// if isForce is set.
 	Sync(isForce bool) (err error)
 }
+
+// metaStore is implemented by metadata.MetaService and metadata.Tx,
+// changes are merged in transactions.
+type metaStore interface {
+	RemoteMod(remoteId string, parentRemoteIds []string, data *metadata.CachedDriveFile) error
+	RemoteRm(remoteId string) error
+	GetByRemoteId(remoteId string) (*metadata.CachedDriveFile, error)
+	GetByLocalId(localId int64) (*metadata.CachedDriveFile, error)
+	SetOp(localId int64, op int) error
+}
@@ -103,6 +103,12 @@ type Conn struct {
 	buf []byte
 	wio sync.Mutex
 
+	// AttrValid and EntryValid are the durations the kernel caches
+	// attributes and directory entries for, unless a response sets
+	// its own. Zero means one minute.
+	AttrValid  time.Duration
+	EntryValid time.Duration
+
 	serveConn
 }
 
@@ -118,6 +124,18 @@ func Mount(dir string) (*Conn, error) {
 	return &Conn{fd: fd}, nil
 }
 
+// notify sends an unsolicited notification to the kernel. Unlike
+// responses, notifications are written without holding wio; the
+// kernel may block the write until it's done with pending requests.
+func (c *Conn) notify(out *outHeader, n uintptr, data []byte) error {
+	out.Len = uint32(n + uintptr(len(data)))
+	msg := make([]byte, out.Len)
+	copy(msg, (*[1 << 30]byte)(unsafe.Pointer(out))[:n])
+	copy(msg[n:], data)
+	_, err := syscall.Write(c.fd, msg)
+	return err
+}
+
 // A Request represents a single FUSE request received from the kernel.
 // Use a type switch to determine the specific kind.
 // A request of unrecognized type will have concrete type *Header.
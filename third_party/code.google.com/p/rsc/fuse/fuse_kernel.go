@@ -537,3 +537,25 @@ type dirent struct {
 }
 
 const direntSize = 8 + 8 + 4 + 4
+
+// Notification codes, sent in the Error field of an outHeader
+// with a zero Unique. Notifications are available since 7.12,
+// Linux accepts them regardless of the negotiated minor version.
+const (
+	notifyInvalInode = 2
+	notifyInvalEntry = 3
+)
+
+type notifyInvalInodeOut struct {
+	outHeader
+	Ino uint64
+	Off int64
+	Len int64
+}
+
+type notifyInvalEntryOut struct {
+	outHeader
+	Parent  uint64
+	Namelen uint32
+	Padding uint32
+}
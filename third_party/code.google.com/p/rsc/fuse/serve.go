@@ -16,6 +16,7 @@ import (
 	"sync"
 	"syscall"
 	"time"
+	"unsafe"
 )
 
 // TODO: FINISH DOCS
@@ -230,13 +231,16 @@ func (c *Conn) Serve(fs FS) error {
 		panic("fuse: Serve called twice")
 	}
 	c.req = map[RequestID]*serveRequest{}
+	c.inodes = map[uint64][]NodeID{}
 
 	root, err := fs.Root()
 	if err != nil {
 		return fmt.Errorf("cannot obtain root node: %v", syscall.Errno(err.(Errno)).Error())
 	}
-	c.node = append(c.node, nil, &serveNode{name: "/", node: root})
+	sn := &serveNode{name: "/", node: root}
+	c.node = append(c.node, nil, sn)
 	c.handle = append(c.handle, nil)
+	c.saveInode(RootID, sn.attr().Inode)
 
 	for {
 		req, err := c.ReadRequest()
@@ -261,6 +265,7 @@ type serveConn struct {
 	freeHandle  []HandleID
 	nodeGen     uint64
 	nodeHandles []map[HandleID]bool // open handles for a node; slice index is NodeID
+	inodes      map[uint64][]NodeID // nodes known to the kernel for an inode
 }
 
 type serveRequest struct {
@@ -343,6 +348,20 @@ func (c *Conn) saveHandle(handle Handle, nodeID NodeID) (id HandleID, shandle *s
 
 func (c *Conn) dropNode(id NodeID) {
 	c.meta.Lock()
+	if sn := c.node[id]; sn != nil {
+		ids := c.inodes[sn.inode]
+		for i, nid := range ids {
+			if nid == id {
+				ids = append(ids[:i], ids[i+1:]...)
+				break
+			}
+		}
+		if len(ids) == 0 {
+			delete(c.inodes, sn.inode)
+		} else {
+			c.inodes[sn.inode] = ids
+		}
+	}
 	c.node[id] = nil
 	if len(c.nodeHandles) > int(id) {
 		c.nodeHandles[id] = nil
@@ -469,7 +488,7 @@ func (c *Conn) serve(fs FS, r Request) {
 				break
 			}
 		} else {
-			s.AttrValid = 1 * time.Minute
+			s.AttrValid = c.attrValid()
 			s.Attr = snode.attr()
 		}
 		done(s)
@@ -518,7 +537,7 @@ func (c *Conn) serve(fs FS, r Request) {
 		}
 
 		if s.AttrValid == 0 {
-			s.AttrValid = 1 * time.Minute
+			s.AttrValid = c.attrValid()
 		}
 		s.Attr = snode.attr()
 		done(s)
@@ -984,12 +1003,77 @@ func (c *Conn) saveLookup(s *LookupResponse, snode *serveNode, elem string, n2 N
 	var sn *serveNode
 	s.Node, s.Generation, sn = c.saveNode(name, n2)
 	if s.EntryValid == 0 {
-		s.EntryValid = 1 * time.Minute
+		s.EntryValid = c.entryValid()
 	}
 	if s.AttrValid == 0 {
-		s.AttrValid = 1 * time.Minute
+		s.AttrValid = c.attrValid()
 	}
 	s.Attr = sn.attr()
+	c.saveInode(s.Node, s.Attr.Inode)
+}
+
+func (c *Conn) saveInode(id NodeID, inode uint64) {
+	c.meta.Lock()
+	c.node[id].inode = inode
+	c.inodes[inode] = append(c.inodes[inode], id)
+	c.meta.Unlock()
+}
+
+func (c *Conn) nodesOf(inode uint64) []NodeID {
+	c.meta.Lock()
+	defer c.meta.Unlock()
+	return append([]NodeID(nil), c.inodes[inode]...)
+}
+
+// InvalidateInode notifies the kernel to drop the cached attributes
+// and data of the nodes with the given inode number. Cached data
+// starting at off is dropped, up to size bytes or to the end of the
+// file if size is not positive. A negative off only drops attributes.
+func (c *Conn) InvalidateInode(inode uint64, off int64, size int64) error {
+	for _, id := range c.nodesOf(inode) {
+		out := &notifyInvalInodeOut{
+			outHeader: outHeader{Error: notifyInvalInode},
+			Ino:       uint64(id),
+			Off:       off,
+			Len:       size,
+		}
+		if err := c.notify(&out.outHeader, unsafe.Sizeof(*out), nil); err != nil && err != syscall.ENOENT {
+			return err
+		}
+	}
+	return nil
+}
+
+// InvalidateEntry notifies the kernel to drop the cached directory
+// entry name under the directories with the given inode number.
+func (c *Conn) InvalidateEntry(parentInode uint64, name string) error {
+	for _, id := range c.nodesOf(parentInode) {
+		out := &notifyInvalEntryOut{
+			outHeader: outHeader{Error: notifyInvalEntry},
+			Parent:    uint64(id),
+			Namelen:   uint32(len(name)),
+		}
+		// name needs to be NUL terminated
+		data := append([]byte(name), 0)
+		if err := c.notify(&out.outHeader, unsafe.Sizeof(*out), data); err != nil && err != syscall.ENOENT {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Conn) attrValid() time.Duration {
+	if c.AttrValid == 0 {
+		return 1 * time.Minute
+	}
+	return c.AttrValid
+}
+
+func (c *Conn) entryValid() time.Duration {
+	if c.EntryValid == 0 {
+		return 1 * time.Minute
+	}
+	return c.EntryValid
 }
 
 // HandleRead handles a read request assuming that data is the entire file content.